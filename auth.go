@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+// resolveAPIToken returns the token given on the command line, falling back to the contents of
+// tokenFile and then to the SLACK_API_TOKEN environment variable.
+func resolveAPIToken(apiToken, tokenFile string) (string, error) {
+	if apiToken != "" {
+		return apiToken, nil
+	}
+	if tokenFile != "" {
+		contents, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read token file: %s", err)
+		}
+		return strings.TrimSpace(string(contents)), nil
+	}
+	if token := os.Getenv(apiTokenEnvVar); token != "" {
+		return token, nil
+	}
+
+	// the keychain may be locked or unavailable (e.g. on a headless CI runner), which is the same as no token
+	token, err := keyring.Get(keyringService, keyringUser)
+	if err != nil {
+		return "", nil
+	}
+	return token, nil
+}
+
+// runAuthCommand implements the 'auth login' and 'auth logout' subcommands, which store the token in
+// (or remove it from) the OS keychain so it doesn't have to be passed on every invocation, and 'auth status',
+// which shows who the token in use belongs to.
+func runAuthCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "login" && args[0] != "status" && args[0] != "logout") {
+		fmt.Println("Usage: auth login|status|logout")
+		fmt.Println("\tlogin\treads a Slack OAuth Access Token from stdin (or obtains one via OAuth with -client_id) and stores it in the OS keychain")
+		fmt.Println("\tstatus\tshows the workspace, identity and scopes of the token the other commands would use")
+		fmt.Println("\tlogout\tremoves the stored token from the OS keychain")
+		return fmt.Errorf("Invalid auth subcommand")
+	}
+
+	if args[0] == "status" {
+		var apiToken string
+		var tokenFile string
+		statusFlags := flag.NewFlagSet("auth status", flag.ExitOnError)
+		statusFlags.StringVar(&apiToken, "api_token", "", "Slack OAuth Access Token (defaults to -token_file, the "+apiTokenEnvVar+" environment variable or the OS keychain)")
+		statusFlags.StringVar(&tokenFile, "token_file", "", "Path of a file containing the Slack OAuth Access Token")
+		statusFlags.Parse(args[1:])
+
+		apiToken, err := resolveAPIToken(apiToken, tokenFile)
+		if err != nil {
+			return err
+		}
+		if apiToken == "" {
+			return fmt.Errorf("No token found: pass -api_token or -token_file, set %s or run 'auth login'", apiTokenEnvVar)
+		}
+		auth, err := getAuthInfo(apiToken)
+		if err != nil {
+			return err
+		}
+		printIdentity(apiToken, auth)
+		return nil
+	}
+
+	if args[0] == "logout" {
+		err := keyring.Delete(keyringService, keyringUser)
+		if err == keyring.ErrNotFound {
+			fmt.Println("No token stored -- nothing to do")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Token removed from the OS keychain")
+		return nil
+	}
+
+	var clientID string
+	var clientSecret string
+	var userScopes string
+	var port int
+
+	loginFlags := flag.NewFlagSet("auth login", flag.ExitOnError)
+	loginFlags.StringVar(&clientID, "client_id", "", "Client ID of your Slack app; when set, a token is obtained through the OAuth flow in your browser")
+	loginFlags.StringVar(&clientSecret, "client_secret", "", "Client secret of your Slack app (defaults to the "+clientSecretEnvVar+" environment variable)")
+	loginFlags.StringVar(&userScopes, "user_scopes", defaultUserScopes, "Comma separated list of user token scopes to request")
+	loginFlags.IntVar(&port, "port", 8085, "Local port for the OAuth callback; add http://localhost:<port>/callback as a redirect URL of your app")
+	loginFlags.Parse(args[1:])
+
+	var token string
+	var err error
+	if clientID != "" {
+		if clientSecret == "" {
+			clientSecret = os.Getenv(clientSecretEnvVar)
+		}
+		if clientSecret == "" {
+			return fmt.Errorf("-client_secret (or %s) is required with -client_id", clientSecretEnvVar)
+		}
+		token, err = runOAuthFlow(clientID, clientSecret, userScopes, port)
+	} else {
+		token, err = readSecret("Slack OAuth Access Token: ")
+	}
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("No token provided")
+	}
+
+	err = keyring.Set(keyringService, keyringUser, token)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Token stored in the OS keychain")
+	return nil
+}
+
+// runOAuthFlow drives the Slack OAuth v2 flow: it serves a temporary callback on localhost, asks the
+// operator to authorize the app in their browser and exchanges the resulting code for a token. The user
+// token is returned if one was granted, otherwise the bot token.
+func runOAuthFlow(clientID, clientSecret, userScopes string, port int) (string, error) {
+	stateBytes := make([]byte, 16)
+	_, err := rand.Read(stateBytes)
+	if err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(stateBytes)
+	redirectURI := fmt.Sprintf("http://localhost:%d/callback", port)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return "", err
+	}
+
+	results := make(chan oauthResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, "Invalid state", http.StatusBadRequest)
+			return
+		}
+
+		var result oauthResult
+		if oauthErr := query.Get("error"); oauthErr != "" {
+			result.err = fmt.Errorf("Authorization failed: %s", oauthErr)
+		} else {
+			result.token, result.err = exchangeOAuthCode(clientID, clientSecret, query.Get("code"), redirectURI)
+		}
+
+		if result.err != nil {
+			fmt.Fprintln(w, "Login failed, check the terminal for details.")
+		} else {
+			fmt.Fprintln(w, "Login successful, you can close this window.")
+		}
+
+		select {
+		case results <- result:
+		default:
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authorizeURL := oauthAuthorizeURL + "?" + url.Values{
+		"client_id":    {clientID},
+		"user_scope":   {userScopes},
+		"redirect_uri": {redirectURI},
+		"state":        {state},
+	}.Encode()
+	fmt.Printf("Open the following URL in your browser to authorize the app:\n\n\t%s\n\n", authorizeURL)
+
+	select {
+	case result := <-results:
+		return result.token, result.err
+	case <-time.After(5 * time.Minute):
+		return "", fmt.Errorf("Timed out waiting for authorization")
+	}
+}
+
+func exchangeOAuthCode(clientID, clientSecret, code, redirectURI string) (string, error) {
+	form := url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+	}
+	req, err := http.NewRequest(http.MethodPost, oauthV2AccessURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	var data oauthV2AccessResponse
+	if _, err := callSlack(req, "exchanging OAuth code", &data); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Authorized for workspace '%s'\n", data.Team.Name)
+	if data.AuthedUser.AccessToken != "" {
+		return data.AuthedUser.AccessToken, nil
+	}
+	return data.AccessToken, nil
+}
+
+// readSecret prompts for a secret without echoing it when stdin is a terminal, or reads the first line
+// of stdin otherwise so the secret can be piped in.
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Print(prompt)
+		secret, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(secret)), nil
+	}
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// runConnectCommand implements the 'connect list', 'connect approve' and 'connect decline' subcommands
+// for pending Slack Connect invitations.
+func runConnectCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "approve" && args[0] != "decline") {
+		fmt.Println("Usage: connect list|approve|decline")
+		fmt.Println("\tlist\tlists pending Slack Connect invitations")
+		fmt.Println("\tapprove\tapproves the invitation given by -invite_id")
+		fmt.Println("\tdecline\tdeclines the invitation given by -invite_id")
+		return fmt.Errorf("Invalid connect subcommand")
+	}
+
+	var apiToken string
+	var tokenFile string
+	var inviteID string
+	var targetTeam string
+
+	connectFlags := flag.NewFlagSet("connect "+args[0], flag.ExitOnError)
+	connectFlags.StringVar(&apiToken, "api_token", "", "Slack OAuth Access Token (defaults to -token_file, the "+apiTokenEnvVar+" environment variable or the OS keychain)")
+	connectFlags.StringVar(&tokenFile, "token_file", "", "Path of a file containing the Slack OAuth Access Token")
+	connectFlags.StringVar(&inviteID, "invite_id", "", "ID of the invitation to approve or decline")
+	connectFlags.StringVar(&targetTeam, "target_team", "", "Team the invitation is for, when the token spans several workspaces (Enterprise Grid)")
+	connectFlags.Parse(args[1:])
+
+	apiToken, err := resolveAPIToken(apiToken, tokenFile)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		invites, err := listConnectInvites(apiToken)
+		if err != nil {
+			return err
+		}
+		if len(invites) == 0 {
+			fmt.Println("No pending Slack Connect invitations")
+			return nil
+		}
+		for _, invite := range invites {
+			created := time.Unix(invite.Invite.DateCreated, 0).Format("2006-01-02")
+			fmt.Printf("%s\t%s\t%s\t#%s\tfrom %s (%s)\t%s\t%s\n", invite.Invite.ID, invite.Direction, invite.Status, invite.Channel.Name, invite.Invite.InvitingUser.Name, invite.Invite.InvitingTeam.Name, invite.Invite.RecipientEmail, created)
+		}
+		return nil
+	}
+
+	if inviteID == "" {
+		return fmt.Errorf("connect %s requires -invite_id", args[0])
+	}
+	endpoint := conversationsApproveURL
+	if args[0] == "decline" {
+		endpoint = conversationsDeclineURL
+	}
+	err = decideConnectInvite(apiToken, endpoint, connectDecisionRequest{InviteID: inviteID, TargetTeam: targetTeam})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Invitation %s %sd\n", inviteID, args[0])
+	return nil
+}
+
+func listConnectInvites(apiToken string) ([]connectInvite, error) {
+	invites := []connectInvite{}
+	var nextCursor string
+	for {
+		var data conversationsListConnectResponse
+		err := slackPost(apiToken, conversationsListConnectURL, conversationsListConnectRequest{Cursor: nextCursor, Count: 200}, "listing Slack Connect invitations", &data)
+		if err != nil {
+			return nil, err
+		}
+
+		invites = append(invites, data.Invites...)
+
+		// paginate if necessary
+		nextCursor = data.ResponseMetadata.NextCursor
+		if nextCursor == "" {
+			return invites, nil
+		}
+	}
+}
+
+// decideConnectInvite approves or declines a Slack Connect invitation, depending on the endpoint.
+func decideConnectInvite(apiToken, endpoint string, decision connectDecisionRequest) error {
+	var data conversationsSetResponse
+	return slackPost(apiToken, endpoint, decision, "deciding on Slack Connect invitation", &data)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/exp/slices"
+)
+
+// getDirectoryGroupUsers looks up the Slack users of the emails of a directory group and combines them with
+// the -emails users according to merge. It also returns the emails that have no Slack user.
+func getDirectoryGroupUsers(apiToken, source string, groupEmails []string, emails, merge string) ([]string, []string) {
+	groupIDs, notFound := getUsersIdsFrom(apiToken, strings.Join(groupEmails, ","), mergeUnion)
+	userIDs, explicitNotFound := withEmailUsers(apiToken, source, groupIDs, emails, merge)
+	return userIDs, append(notFound, explicitNotFound...)
+}
+
+// withEmailUsers combines the users of a source with the -emails users according to merge. It also returns
+// the emails that have no Slack user.
+func withEmailUsers(apiToken, source string, sourceIDs []string, emails, merge string) ([]string, []string) {
+	sources := []userSource{{name: source, userIDs: sourceIDs}}
+	var notFound []string
+	if emails != "" {
+		var explicit []string
+		explicit, notFound = getUsersIdsFrom(apiToken, emails, merge)
+		sources = append(sources, userSource{name: "emails", userIDs: explicit})
+	}
+	return mergeUserSources(sources, merge), notFound
+}
+
+// getEntraGroupEmails returns the emails of the enabled users in the Entra ID group, including those in
+// nested groups. The app signs in with its client secret and needs the GroupMember.Read.All and
+// User.Read.All application permissions on Microsoft Graph.
+func getEntraGroupEmails(tenant, clientID, clientSecret, groupID string) ([]string, error) {
+	form := url.Values{"client_id": {clientID}, "client_secret": {clientSecret}, "scope": {entraGraphScope}, "grant_type": {"client_credentials"}}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(entraTokenURL, url.PathEscape(tenant)), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := slackAPI.doExternal(requestCtx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var token entraTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return nil, fmt.Errorf("Unable to get a Microsoft Graph access token: %s %s", token.Error, token.ErrorDescription)
+	}
+
+	emails := []string{}
+	nextLink := fmt.Sprintf(entraGroupMembersURL, url.PathEscape(groupID)) + "?$select=mail,userPrincipalName,accountEnabled&$top=999"
+	for nextLink != "" {
+		req, err := http.NewRequest(http.MethodGet, nextLink, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+
+		var data entraMembersResponse
+		_, err = getDirectoryPage(req, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range data.Value {
+			// users without a mailbox usually still sign in with their email
+			email := member.Mail
+			if email == "" {
+				email = member.UserPrincipalName
+			}
+			if member.AccountEnabled && email != "" && !slices.Contains(emails, email) {
+				emails = append(emails, email)
+			}
+		}
+		nextLink = data.NextLink
+	}
+	return emails, nil
+}
+
+// getDirectoryPage sends the request for a page of group members and decodes the JSON response into v,
+// returning the response headers for the APIs that link to the next page in them.
+func getDirectoryPage(req *http.Request, v interface{}) (http.Header, error) {
+	resp, err := slackAPI.doExternal(requestCtx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := printErrorResponseBody(resp)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Non-200 status code (%d)", resp.StatusCode)
+	}
+	return resp.Header, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getOktaGroupEmails returns the emails of the active users assigned to the Okta group.
+func getOktaGroupEmails(orgURL, apiToken, groupID string) ([]string, error) {
+	emails := []string{}
+	nextURL := strings.TrimSuffix(orgURL, "/") + fmt.Sprintf(oktaGroupUsersPath, url.PathEscape(groupID)) + "?limit=200"
+	for nextURL != "" {
+		req, err := http.NewRequest(http.MethodGet, nextURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("Authorization", fmt.Sprintf("SSWS %s", apiToken))
+
+		var users []oktaUser
+		header, err := getDirectoryPage(req, &users)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range users {
+			email := u.Profile.Email
+			if email == "" {
+				email = u.Profile.Login
+			}
+			if u.Status == "ACTIVE" && email != "" && !slices.Contains(emails, email) {
+				emails = append(emails, email)
+			}
+		}
+		nextURL = nextLinkURL(header.Values("Link"))
+	}
+	return emails, nil
+}
+
+// nextLinkURL returns the URL of the rel="next" entry of Link headers, or an empty string on the last page.
+func nextLinkURL(links []string) string {
+	for _, header := range links {
+		for _, link := range strings.Split(header, ",") {
+			target, params, _ := strings.Cut(link, ";")
+			if strings.Contains(params, `rel="next"`) {
+				return strings.Trim(strings.TrimSpace(target), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+// getGitHubTeamEmails returns an email for every member of the GitHub team ('org/team'), preferring the
+// ones they verified for the organization's domains over their public email. Members without either are
+// reported and left out.
+func getGitHubTeamEmails(graphQLURL, githubToken, team string) ([]string, error) {
+	org, slug, ok := strings.Cut(team, "/")
+	if !ok || org == "" || slug == "" {
+		return nil, fmt.Errorf("invalid GitHub team '%s', expected 'org/team'", team)
+	}
+
+	emails := []string{}
+	var cursor interface{}
+	for {
+		body, err := json.Marshal(map[string]interface{}{
+			"query":     githubTeamMembersQuery,
+			"variables": map[string]interface{}{"org": org, "team": slug, "cursor": cursor},
+		})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, graphQLURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", githubToken))
+
+		var data githubTeamMembersResponse
+		_, err = getDirectoryPage(req, &data)
+		if err != nil {
+			return nil, err
+		}
+		if len(data.Errors) > 0 {
+			return nil, fmt.Errorf("%s", data.Errors[0].Message)
+		}
+		if data.Data.Organization == nil || data.Data.Organization.Team == nil {
+			return nil, fmt.Errorf("GitHub team '%s' not found", team)
+		}
+
+		members := data.Data.Organization.Team.Members
+		for _, member := range members.Nodes {
+			email := member.Email
+			if len(member.OrganizationVerifiedDomainEmails) > 0 {
+				email = member.OrganizationVerifiedDomainEmails[0]
+			}
+			if email == "" {
+				logWarn("GitHub user %s has no verified or public email -- skipping", member.Login)
+				continue
+			}
+			if !slices.Contains(emails, email) {
+				emails = append(emails, email)
+			}
+		}
+
+		if !members.PageInfo.HasNextPage {
+			return emails, nil
+		}
+		cursor = members.PageInfo.EndCursor
+	}
+}
+
+// searchLDAPEmails returns the values of the attribute of every entry under the base DN matching the
+// filter. It binds with the DN and password (anonymously if the DN is empty) over ldap:// or ldaps://; over
+// ldap://, a password is only sent once the connection is switched to TLS with StartTLS.
+func searchLDAPEmails(serverURL, bindDN, password, baseDN, filter, attribute string) ([]string, error) {
+	// the parentheses around a single filter are optional, as in ldapsearch
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	if _, err := ldap.CompileFilter(filter); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("invalid -ldap_url '%s', expected 'ldap://' or 'ldaps://'", serverURL)
+	}
+	// the TLS settings of -ca_bundle and -tls_min_version apply to the directory too
+	tlsConfig := &tls.Config{}
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	ber.MaxPacketLengthBytes = maxBERElement
+	conn, err := ldap.DialURL(serverURL, ldap.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(5 * time.Minute)
+	// Ctrl-C and -timeout abort the search
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-requestCtx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// a simple bind sends the password as is, so it never goes over a connection in the clear
+	if u.Scheme == "ldap" && password != "" {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s, use ldaps:// to bind with a password", err)
+		}
+	}
+	_, err = conn.SimpleBind(&ldap.SimpleBindRequest{Username: bindDN, Password: password, AllowEmptyPassword: password == ""})
+	if err != nil {
+		return nil, err
+	}
+
+	// whole subtree, never dereferencing aliases, without size or time limits, paged so directories with a
+	// size limit (like Active Directory's 1000 entries) return every entry
+	search := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, []string{attribute}, nil)
+	result, err := conn.SearchWithPaging(search, ldapPageSize)
+	if err != nil {
+		return nil, err
+	}
+	emails := []string{}
+	for _, entry := range result.Entries {
+		for _, value := range entry.GetAttributeValues(attribute) {
+			if !slices.Contains(emails, value) {
+				emails = append(emails, value)
+			}
+		}
+	}
+	conn.Unbind()
+	return emails, nil
+}
+
+// getGoogleGroupEmails returns the emails of the active users in the Google Workspace group, including
+// those in nested groups, using the service account with domain-wide delegation as the admin.
+func getGoogleGroupEmails(credentialsPath, admin, group string) ([]string, error) {
+	accessToken, err := getGoogleAccessToken(credentialsPath, admin, googleMembersScope)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := []string{}
+	var pageToken string
+	for {
+		query := url.Values{"includeDerivedMembership": {"true"}, "maxResults": {"200"}, "pageToken": {pageToken}}
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(googleGroupMembersURL, url.PathEscape(group))+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+		var data googleMembersResponse
+		_, err = getDirectoryPage(req, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		// nested groups are listed too, next to their members
+		for _, member := range data.Members {
+			if member.Type == "USER" && member.Status == "ACTIVE" && !slices.Contains(emails, member.Email) {
+				emails = append(emails, member.Email)
+			}
+		}
+
+		pageToken = data.NextPageToken
+		if pageToken == "" {
+			return emails, nil
+		}
+	}
+}
+
+// getGoogleAccessToken exchanges a JWT signed with the service account key for an access token acting as
+// the subject.
+func getGoogleAccessToken(credentialsPath, subject, scope string) (string, error) {
+	contents, err := os.ReadFile(credentialsPath)
+	if err != nil {
+		return "", err
+	}
+	var account googleServiceAccount
+	err = json.Unmarshal(contents, &account)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse Google credentials %s: %s", credentialsPath, err)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = googleTokenURL
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("No private key found in Google credentials %s", credentialsPath)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("Invalid private key in Google credentials %s: %s", credentialsPath, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("The private key in Google credentials %s isn't an RSA key", credentialsPath)
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"sub":   subject,
+		"scope": scope,
+		"aud":   account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {unsigned + "." + encode(signature)}}
+	req, err := http.NewRequest(http.MethodPost, account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := slackAPI.doExternal(requestCtx, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var data googleTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || data.AccessToken == "" {
+		return "", fmt.Errorf("Unable to get a Google access token: %s %s", data.Error, data.ErrorDescription)
+	}
+	return data.AccessToken, nil
+}
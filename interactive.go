@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+// pickInteractively lets the user pick channels and users from searchable lists for whichever of
+// channelsArg and emails wasn't given on the command line, and returns both.
+func pickInteractively(apiToken, channelsArg, emails, emailsFile string, channelNameToIDMap map[string]string) (string, string, error) {
+	if channelsArg == "" {
+		names := maps.Keys(channelNameToIDMap)
+		sort.Strings(names)
+		picked := pickItems("channels", names)
+		if len(picked) == 0 {
+			return "", "", fmt.Errorf("No channels picked")
+		}
+		channelsArg = strings.Join(picked, ",")
+	}
+
+	if emails == "" && emailsFile == "" {
+		fmt.Println("\nLoading users ...")
+		users, err := listUsers(apiToken)
+		if err != nil {
+			return "", "", err
+		}
+		labels := make([]string, 0, len(users))
+		byLabel := map[string]string{}
+		for _, u := range users {
+			label := fmt.Sprintf("%s (%s) %s", u.RealName, u.Name, u.Profile.Email)
+			labels = append(labels, label)
+			byLabel[label] = u.ID
+		}
+		sort.Strings(labels)
+		picked := pickItems("users", labels)
+		if len(picked) == 0 {
+			return "", "", fmt.Errorf("No users picked")
+		}
+		userIDs := make([]string, 0, len(picked))
+		for _, label := range picked {
+			userIDs = append(userIDs, byLabel[label])
+		}
+		emails = strings.Join(userIDs, ",")
+	}
+
+	return channelsArg, emails, nil
+}
+
+// pickItems repeatedly asks for a search term, lists the items fuzzily matching it and toggles the ones
+// chosen by number, until an empty search term is entered. The picked items are returned in list order.
+func pickItems(label string, items []string) []string {
+	const shown = 20
+	selected := map[string]bool{}
+	for {
+		fmt.Printf("\nSearch %s (%d selected, empty to finish): ", label, len(selected))
+		query, err := stdin.ReadString('\n')
+		query = strings.TrimSpace(query)
+		if query == "" || err != nil {
+			break
+		}
+
+		matches := fuzzyFilter(items, query)
+		if len(matches) == 0 {
+			fmt.Println("No matches")
+			continue
+		}
+		if len(matches) > shown {
+			fmt.Printf("%d matches, showing the first %d -- refine the search to see the others\n", len(matches), shown)
+			matches = matches[:shown]
+		}
+		for i, item := range matches {
+			mark := " "
+			if selected[item] {
+				mark = "*"
+			}
+			fmt.Printf("%s %2d) %s\n", mark, i+1, item)
+		}
+
+		fmt.Print("Toggle (e.g. '1,3-5', 'a' for all shown, empty for none): ")
+		answer, _ := stdin.ReadString('\n')
+		for _, i := range parseSelection(strings.TrimSpace(answer), len(matches)) {
+			selected[matches[i]] = !selected[matches[i]]
+			if !selected[matches[i]] {
+				delete(selected, matches[i])
+			}
+		}
+	}
+
+	picked := []string{}
+	for _, item := range items {
+		if selected[item] {
+			picked = append(picked, item)
+		}
+	}
+	return picked
+}
+
+// fuzzyFilter returns the items containing the characters of query in order (case insensitive), with
+// items containing query as a substring first.
+func fuzzyFilter(items []string, query string) []string {
+	query = strings.ToLower(query)
+	exact := []string{}
+	fuzzy := []string{}
+	for _, item := range items {
+		lower := strings.ToLower(item)
+		if strings.Contains(lower, query) {
+			exact = append(exact, item)
+			continue
+		}
+		rest := lower
+		matched := true
+		for _, r := range query {
+			i := strings.IndexRune(rest, r)
+			if i < 0 {
+				matched = false
+				break
+			}
+			rest = rest[i+len(string(r)):]
+		}
+		if matched {
+			fuzzy = append(fuzzy, item)
+		}
+	}
+	return append(exact, fuzzy...)
+}
+
+// parseSelection turns "1,3-5" (1-based) or "a" into 0-based indexes below n, ignoring anything invalid.
+func parseSelection(answer string, n int) []int {
+	indexes := []int{}
+	if answer == "a" {
+		for i := 0; i < n; i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+	for _, part := range strings.Split(answer, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			continue
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(to)
+			if err != nil {
+				continue
+			}
+		}
+		for i := first; i <= last; i++ {
+			if i >= 1 && i <= n {
+				indexes = append(indexes, i-1)
+			}
+		}
+	}
+	return indexes
+}
+
+// confirm asks the operator a yes/no question on stdin and reports whether they answered yes.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,1496 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slices"
+)
+
+const testToken = "xoxp-test"
+
+// startTestSlack serves testdata/workspace.json as the Slack API for the duration of the test and returns
+// the mock, so tests can check what changed.
+func startTestSlack(t *testing.T) *mockSlack {
+	t.Helper()
+	server, err := startMockSlack("testdata/workspace.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := logs.out
+	logs.out = io.Discard
+	t.Cleanup(func() {
+		server.Close()
+		apiBaseURL = nil
+		logs.out = out
+		userInfos.users = map[string]user{}
+		workspaceUsers = nil
+	})
+	return server.Config.Handler.(*mockSlack)
+}
+
+func TestGetChannels(t *testing.T) {
+	startTestSlack(t)
+
+	tests := []struct {
+		name     string
+		private  bool
+		archived bool
+		want     []string
+	}{
+		{"public", false, false, []string{"dubnation", "splashbrothers"}},
+		{"private", true, false, []string{"dubnation", "front-office", "splashbrothers"}},
+		{"archived", false, true, []string{"dubnation", "oracle-arena", "splashbrothers"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channels, err := getChannels(testToken, tt.private, false, tt.archived, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for name := range channels {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("got channels %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetUsersIdsFrom(t *testing.T) {
+	startTestSlack(t)
+
+	userIDs, notFound := getUsersIdsFrom(testToken, "steph@warriors.com,KLAY@warriors.com,kd@warriors.com,draymond@warriors.com", mergeUnion)
+	slices.Sort(userIDs)
+	if want := []string{"U0KLAY", "U0STEPH"}; !slices.Equal(userIDs, want) {
+		t.Errorf("got users %v, want %v (deactivated users are skipped)", userIDs, want)
+	}
+	if want := []string{"draymond@warriors.com"}; !slices.Equal(notFound, want) {
+		t.Errorf("got not found %v, want %v", notFound, want)
+	}
+}
+
+func TestInviteUsersToChannel(t *testing.T) {
+	mock := startTestSlack(t)
+
+	failed, alreadyIn, err := inviteUsersToChannel(testToken, []string{"U0STEPH", "U0KLAY", "U0KD"}, "C0DUB", "dubnation", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// steph is already in the channel, which isn't a failure
+	if len(failed) != 1 || failed[0].User != "U0KD" || failed[0].Error != "cant_invite" {
+		t.Errorf("got failed users %+v, want only U0KD with cant_invite", failed)
+	}
+	if !slices.Equal(alreadyIn, []string{"U0STEPH"}) {
+		t.Errorf("got users already in the channel %v, want [U0STEPH]", alreadyIn)
+	}
+	if members := mock.channel("C0DUB").Members; !slices.Contains(members, "U0KLAY") {
+		t.Errorf("U0KLAY wasn't invited, members are %v", members)
+	}
+}
+
+func TestRemoveUsersFromChannel(t *testing.T) {
+	mock := startTestSlack(t)
+
+	removed, err := removeUsersFromChannel(testToken, []string{"U0KLAY", "U0STEPH"}, "C0DUB", "dubnation", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{"U0STEPH"}) {
+		t.Errorf("got users removed %v, want only U0STEPH (U0KLAY isn't in the channel)", removed)
+	}
+	if members := mock.channel("C0DUB").Members; slices.Contains(members, "U0STEPH") {
+		t.Errorf("U0STEPH wasn't removed, members are %v", members)
+	}
+}
+
+func TestRemoveUsersFromChannelError(t *testing.T) {
+	mock := startTestSlack(t)
+	mock.fixture.Errors = map[string]string{"conversations.kick": "restricted_action"}
+
+	removed, err := removeUsersFromChannel(testToken, []string{"U0STEPH"}, "C0DUB", "dubnation", false)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(removed) != 0 {
+		t.Errorf("got users removed %v, want none", removed)
+	}
+}
+
+func TestApplyToChannels(t *testing.T) {
+	startTestSlack(t)
+
+	channels, err := getChannels(testToken, false, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := &runSummary{Action: actionAdd}
+	opts := runOptions{batchSize: maxInviteBatchSize}
+	applyToChannels(testToken, actionAdd, []string{"U0KLAY"}, []string{"dubnation", "splashbrothers", "warriors"}, channels, opts, summary)
+
+	if summary.Invited != 2 || summary.Failed != 1 {
+		t.Errorf("got %d invited and %d failed, want 2 invited and 1 failed", summary.Invited, summary.Failed)
+	}
+	if code := summary.exitCode(); code != exitPartialFailure {
+		t.Errorf("got exit code %d, want %d", code, exitPartialFailure)
+	}
+}
+
+func TestDoWithContext(t *testing.T) {
+	startTestSlack(t)
+
+	// a call gets its own deadline without the rest of the run being cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, conversationsListURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slackAPI.do(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want the deadline of the call to be exceeded", err)
+	}
+	if _, err := getChannels(testToken, false, false, false, false); err != nil {
+		t.Errorf("got error %v for a call without a deadline", err)
+	}
+}
+
+func TestNotifyOwnerOfChanges(t *testing.T) {
+	mock := startTestSlack(t)
+
+	channels, err := getChannels(testToken, false, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := runOptions{batchSize: maxInviteBatchSize, notifyOwner: true}
+	applyToChannels(testToken, actionAdd, []string{"U0STEPH", "U0KLAY"}, []string{"dubnation"}, channels, opts, &runSummary{Action: actionAdd})
+	// steph was in the channel already, so only klay is news to the owner
+	if len(mock.posted) != 1 || !strings.Contains(mock.posted[0].Text, "Added: <@U0KLAY>\n") {
+		t.Errorf("got posted messages %+v, want the owner told only about U0KLAY", mock.posted)
+	}
+
+	// nobody new, nothing to tell
+	applyToChannels(testToken, actionAdd, []string{"U0STEPH"}, []string{"dubnation"}, channels, opts, &runSummary{Action: actionAdd})
+	if len(mock.posted) != 1 {
+		t.Errorf("got posted messages %+v, want no message when nobody was added", mock.posted)
+	}
+}
+
+func TestWelcomeMessageMentionsAddedUsers(t *testing.T) {
+	mock := startTestSlack(t)
+
+	channels, err := getChannels(testToken, false, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := runOptions{batchSize: maxInviteBatchSize, welcomeMessage: "Welcome!"}
+	applyToChannels(testToken, actionAdd, []string{"U0STEPH", "U0KLAY", "U0KD"}, []string{"dubnation"}, channels, opts, &runSummary{Action: actionAdd})
+	// steph was in the channel already and kd couldn't be invited
+	if len(mock.posted) != 1 || mock.posted[0].Text != "<@U0KLAY> Welcome!" {
+		t.Errorf("got posted messages %+v, want the welcome to mention only U0KLAY", mock.posted)
+	}
+
+	applyToChannels(testToken, actionAdd, []string{"U0STEPH"}, []string{"dubnation"}, channels, opts, &runSummary{Action: actionAdd})
+	if len(mock.posted) != 1 {
+		t.Errorf("got posted messages %+v, want no welcome when nobody was added", mock.posted)
+	}
+}
+
+func TestInviteDMsListChannelsAdded(t *testing.T) {
+	mock := startTestSlack(t)
+
+	channels, err := getChannels(testToken, false, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := runOptions{batchSize: maxInviteBatchSize, dmTemplate: template.Must(template.New("dm").Parse("{{.ChannelNames}}"))}
+	applyToChannels(testToken, actionAdd, []string{"U0STEPH", "U0KLAY", "U0KD"}, []string{"dubnation", "splashbrothers"}, channels, opts, &runSummary{Action: actionAdd})
+	// steph was in dubnation already and kd couldn't be invited anywhere, so kd gets no DM
+	got := []string{}
+	for _, message := range mock.posted {
+		got = append(got, message.Text)
+	}
+	if want := []string{"splashbrothers", "dubnation, splashbrothers"}; !slices.Equal(got, want) {
+		t.Errorf("got DMs %q, want %q", got, want)
+	}
+}
+
+func TestSyncChannelsToUsergroup(t *testing.T) {
+	mock := startTestSlack(t)
+
+	channels, err := getChannels(testToken, false, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bot in dubnation would make Slack reject the whole update
+	err = syncChannelsToUsergroup(testToken, []string{"dubnation"}, "@dubs", channels, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.fixture.Usergroups) != 1 || !slices.Equal(mock.fixture.Usergroups[0].Users, []string{"U0ADMIN", "U0STEPH"}) {
+		t.Errorf("got user groups %+v, want '@dubs' with only U0ADMIN and U0STEPH", mock.fixture.Usergroups)
+	}
+}
+
+func TestArchiveChannelsConfirms(t *testing.T) {
+	mock := startTestSlack(t)
+	defer func(r *bufio.Reader) { stdin = r }(stdin)
+
+	channels, err := getChannels(testToken, false, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin = bufio.NewReader(strings.NewReader("n\n"))
+	archiveChannels(testToken, []string{"dubnation"}, channels, true, true, false, &runSummary{Action: actionArchive})
+	if mock.channel("C0DUB").IsArchived {
+		t.Error("dubnation was archived although the prompt was declined")
+	}
+
+	stdin = bufio.NewReader(strings.NewReader("y\n"))
+	archiveChannels(testToken, []string{"dubnation"}, channels, true, true, false, &runSummary{Action: actionArchive})
+	if !mock.channel("C0DUB").IsArchived {
+		t.Error("dubnation wasn't archived although the prompt was accepted")
+	}
+}
+
+func TestGetAllChannelsForUser(t *testing.T) {
+	mock := startTestSlack(t)
+
+	channels, err := getAllChannelsForUser(testToken, "U0ADMIN", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dubnation", "front-office", "splashbrothers"}
+	if !slices.Equal(channels, want) {
+		t.Errorf("got channels %v, want %v", channels, want)
+	}
+
+	// without the scope for users.conversations, every channel is scanned instead
+	mock.fixture.Errors = map[string]string{"users.conversations": "missing_scope"}
+	channels, err = getAllChannelsForUser(testToken, "U0ADMIN", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(channels, want) {
+		t.Errorf("got channels %v from the scan, want %v", channels, want)
+	}
+}
+
+func TestFetchChannelMembers(t *testing.T) {
+	startTestSlack(t)
+
+	channels, err := getChannels(testToken, true, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := fetchChannelMembers(testToken, []string{"dubnation", "front-office", "warriors"}, channels, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"U0ADMIN", "U0STEPH", "B0BOT"}; !slices.Equal(members["dubnation"], want) {
+		t.Errorf("got dubnation members %v, want %v", members["dubnation"], want)
+	}
+	if _, ok := members["warriors"]; ok {
+		t.Errorf("got members for a channel that doesn't exist")
+	}
+}
+
+func TestFetchChannelMembersStopsOnError(t *testing.T) {
+	mock := startTestSlack(t)
+	stats := requestStats
+	requestStats = &apiStats{endpoints: map[string]*endpointStats{}}
+	t.Cleanup(func() { requestStats = stats })
+
+	channels, err := getChannels(testToken, true, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.fixture.Errors = map[string]string{"conversations.members": "not_in_channel"}
+	if _, err := fetchChannelMembers(testToken, []string{"dubnation", "splashbrothers", "front-office"}, channels, 1, false); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := requestStats.endpoints["conversations.members"].Requests; got != 1 {
+		t.Errorf("got %d conversations.members requests, want the channels after the failed one left alone", got)
+	}
+}
+
+func TestGetUserInfoMemoized(t *testing.T) {
+	mock := startTestSlack(t)
+
+	if _, err := getUserInfo(testToken, "U0STEPH"); err != nil {
+		t.Fatal(err)
+	}
+	// a second lookup must not reach Slack
+	mock.fixture.Errors = map[string]string{"users.info": "ratelimited"}
+	u, err := getUserInfo(testToken, "U0STEPH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != "U0STEPH" {
+		t.Errorf("got user %s, want U0STEPH", u.ID)
+	}
+}
+
+func TestGetUserIDCachedDeactivated(t *testing.T) {
+	mock := startTestSlack(t)
+	cache, err := loadUserCache(filepath.Join(t.TempDir(), "users.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailCache = cache
+	t.Cleanup(func() { emailCache = nil })
+
+	for _, email := range []string{"steph@warriors.com", "kd@warriors.com"} {
+		getUserID(testToken, email)
+	}
+	// the second lookups come from the cache, and a deactivated user still can't be invited
+	mock.fixture.Errors = map[string]string{"users.lookupByEmail": "internal_error"}
+	if userID, err := getUserID(testToken, "steph@warriors.com"); err != nil || userID != "U0STEPH" {
+		t.Errorf("got %s, %v for steph, want U0STEPH", userID, err)
+	}
+	if _, err := getUserID(testToken, "kd@warriors.com"); err != errUserDeactivated {
+		t.Errorf("got error %v for kd, want errUserDeactivated", err)
+	}
+}
+
+func TestGetUsersIdsFromNames(t *testing.T) {
+	startTestSlack(t)
+
+	userIDs, _ := getUsersIdsFrom(testToken, `@steph,"klay thompson",@scorebot,"Curry"`, mergeUnion)
+	// bots can't be matched, and "Curry" is the display name of two users
+	if want := []string{"U0STEPH", "U0KLAY"}; !slices.Equal(userIDs, want) {
+		t.Errorf("got users %v, want %v", userIDs, want)
+	}
+}
+
+func TestParseMentions(t *testing.T) {
+	entries := []string{"<@U0STEPH> and <@U0KLAY|klay> please join", "@U0ADMIN", "@oncall-team", "kd@warriors.com"}
+	want := []string{"U0STEPH", "U0KLAY", "U0ADMIN", "@oncall-team", "kd@warriors.com"}
+	if got := parseMentions(entries); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestGetMentionedUsers(t *testing.T) {
+	startTestSlack(t)
+
+	tests := []struct {
+		name string
+		link string
+		want []string
+	}{
+		{"message", "https://warriors.slack.com/archives/C0DUB/p1700000000000100", []string{"U0STEPH", "U0KLAY"}},
+		{"reply", "https://warriors.slack.com/archives/C0DUB/p1700000100000200?thread_ts=1700000000.000100&cid=C0DUB", []string{"U0SETH"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userIDs, err := getMentionedUsers(testToken, tt.link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(userIDs, tt.want) {
+				t.Errorf("got users %v, want %v", userIDs, tt.want)
+			}
+		})
+	}
+
+	if _, err := getMentionedUsers(testToken, "https://warriors.slack.com/archives/C0DUB"); err == nil {
+		t.Error("expected an error for a channel link")
+	}
+}
+
+func TestGetReactingUsers(t *testing.T) {
+	startTestSlack(t)
+
+	link := "https://warriors.slack.com/archives/C0DUB/p1700000000000100"
+	tests := []struct {
+		emoji string
+		want  []string
+	}{
+		{":raised_hand:", []string{"U0STEPH", "U0KLAY"}},
+		{"eyes", []string{"U0ADMIN"}},
+		{"", []string{"U0STEPH", "U0KLAY", "U0ADMIN"}},
+	}
+	for _, tt := range tests {
+		userIDs, err := getReactingUsers(testToken, link, tt.emoji)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(userIDs, tt.want) {
+			t.Errorf("got users %v for '%s', want %v", userIDs, tt.emoji, tt.want)
+		}
+	}
+}
+
+func TestGetThreadParticipants(t *testing.T) {
+	startTestSlack(t)
+
+	// the parent message and any reply lead to the same thread
+	for _, link := range []string{
+		"https://warriors.slack.com/archives/C0DUB/p1700000000000100",
+		"https://warriors.slack.com/archives/C0DUB/p1700000100000200?thread_ts=1700000000.000100&cid=C0DUB",
+	} {
+		userIDs, err := getThreadParticipants(testToken, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"U0ADMIN", "U0STEPH"}; !slices.Equal(userIDs, want) {
+			t.Errorf("got users %v for %s, want %v", userIDs, link, want)
+		}
+	}
+}
+
+func TestRemoveFromAllChannels(t *testing.T) {
+	mock := startTestSlack(t)
+
+	channels, err := getChannels(testToken, true, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := &runSummary{Action: actionRemoveAll}
+	removeFromAllChannels(testToken, []string{"U0STEPH", "U0KLAY"}, []string{"dub*", "splash*"}, channels, false, false, false, summary)
+
+	if summary.Removed != 1 || summary.Failed != 0 {
+		t.Errorf("got %d removed and %d failed, want 1 removed and 0 failed", summary.Removed, summary.Failed)
+	}
+	if members := mock.channel("C0DUB").Members; slices.Contains(members, "U0STEPH") {
+		t.Errorf("U0STEPH wasn't removed from C0DUB, members are %v", members)
+	}
+	// front-office doesn't match the patterns
+	if members := mock.channel("C0FRONT").Members; !slices.Contains(members, "U0STEPH") {
+		t.Errorf("U0STEPH was removed from C0FRONT, members are %v", members)
+	}
+}
+
+func TestParsePace(t *testing.T) {
+	if interval, err := parsePace("30/m"); err != nil || interval != 2*time.Second {
+		t.Errorf("got %s and error %v for 30/m, want 2s", interval, err)
+	}
+	for _, pace := range []string{"1e12/s", "Inf/s", "NaN/s", "0/s", "1/d"} {
+		if interval, err := parsePace(pace); err == nil {
+			t.Errorf("got %s for %s, want an error", interval, pace)
+		}
+	}
+}
+
+func TestExpandChannelSets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte("channel_sets:\n  onboarding: [general-eng, help-it, social]\n  oncall: [incidents, social]\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channelSets, err := applyProfile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channels, err := expandChannelSets("dubnation", "onboarding,oncall", channelSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "dubnation,general-eng,help-it,social,incidents"; channels != want {
+		t.Errorf("got channels %s, want %s", channels, want)
+	}
+	if _, err := expandChannelSets("", "offboarding", channelSets); err == nil {
+		t.Error("expected an error for an unknown channel set")
+	}
+}
+
+func TestGetGoogleAccessToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the token endpoint checks the signature and claims of the assertion like Google's would
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			t.Errorf("got assertion %q, want a JWT", r.FormValue("assertion"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("invalid signature: %s", err)
+		}
+		var claims map[string]interface{}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(payload, &claims)
+		if claims["sub"] != "admin@warriors.com" || claims["iss"] != "invites@warriors.iam.gserviceaccount.com" {
+			t.Errorf("got claims %v", claims)
+		}
+		json.NewEncoder(w).Encode(googleTokenResponse{AccessToken: "ya29.test"})
+	}))
+	defer server.Close()
+
+	account, _ := json.Marshal(googleServiceAccount{
+		ClientEmail: "invites@warriors.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    server.URL,
+	})
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(path, account, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	accessToken, err := getGoogleAccessToken(path, "admin@warriors.com", googleMembersScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != "ya29.test" {
+		t.Errorf("got access token %s, want ya29.test", accessToken)
+	}
+}
+
+// hostRewriter sends every request to the test server at target, whatever host its URL names.
+type hostRewriter struct {
+	target *url.URL
+}
+
+func (h hostRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = h.target.Scheme, h.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGetEntraGroupEmails(t *testing.T) {
+	// the second page is only reachable through @odata.nextLink, which points at Graph itself
+	pages := map[string]string{
+		"": `{"value": [
+			{"mail": "steph@warriors.com", "userPrincipalName": "steph@warriors.onmicrosoft.com", "accountEnabled": true},
+			{"mail": "kd@warriors.com", "userPrincipalName": "kd@warriors.onmicrosoft.com", "accountEnabled": false},
+			{"mail": "", "userPrincipalName": "klay@warriors.com", "accountEnabled": true}
+		], "@odata.nextLink": "https://graph.microsoft.com/v1.0/groups/0dubs/transitiveMembers/microsoft.graph.user?$skiptoken=2"}`,
+		"2": `{"value": [
+			{"mail": "draymond@warriors.com", "userPrincipalName": "draymond@warriors.com", "accountEnabled": true},
+			{"mail": "steph@warriors.com", "userPrincipalName": "steph@warriors.onmicrosoft.com", "accountEnabled": true}
+		]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/warriors.com/oauth2/v2.0/token":
+			if r.FormValue("client_id") != "invites" || r.FormValue("client_secret") != "entra-secret" || r.FormValue("grant_type") != "client_credentials" {
+				w.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(w, `{"error": "invalid_client", "error_description": "bad credentials"}`)
+				return
+			}
+			io.WriteString(w, `{"access_token": "graph-token"}`)
+		case "/v1.0/groups/0dubs/transitiveMembers/microsoft.graph.user":
+			if r.Header.Get("Authorization") != "Bearer graph-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			io.WriteString(w, pages[r.URL.Query().Get("$skiptoken")])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	client := slackAPI.httpClient
+	slackAPI.httpClient = &http.Client{Transport: hostRewriter{target: target}}
+	t.Cleanup(func() { slackAPI.httpClient = client })
+
+	emails, err := getEntraGroupEmails("warriors.com", "invites", "entra-secret", "0dubs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kd's account is disabled, klay has no mailbox and signs in with their email
+	if want := []string{"steph@warriors.com", "klay@warriors.com", "draymond@warriors.com"}; !slices.Equal(emails, want) {
+		t.Errorf("got emails %v, want %v", emails, want)
+	}
+
+	if _, err := getEntraGroupEmails("warriors.com", "invites", "wrong-secret", "0dubs"); err == nil || !strings.Contains(err.Error(), "bad credentials") {
+		t.Errorf("got error %v, want the token request to be refused", err)
+	}
+}
+
+func TestGetOktaGroupEmails(t *testing.T) {
+	pages := map[string]string{
+		"":  `[{"status": "ACTIVE", "profile": {"email": "steph@warriors.com"}}, {"status": "DEPROVISIONED", "profile": {"email": "kd@warriors.com"}}]`,
+		"2": `[{"status": "ACTIVE", "profile": {"login": "klay@warriors.com"}}]`,
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/groups/00gDUBS/users" || r.Header.Get("Authorization") != "SSWS okta-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		after := r.URL.Query().Get("after")
+		if after == "" {
+			w.Header().Add("Link", "<"+server.URL+"/api/v1/groups/00gDUBS/users?limit=200>; rel=\"self\"")
+			w.Header().Add("Link", "<"+server.URL+"/api/v1/groups/00gDUBS/users?after=2&limit=200>; rel=\"next\"")
+		}
+		io.WriteString(w, pages[after])
+	}))
+	defer server.Close()
+
+	emails, err := getOktaGroupEmails(server.URL+"/", "okta-token", "00gDUBS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"steph@warriors.com", "klay@warriors.com"}; !slices.Equal(emails, want) {
+		t.Errorf("got emails %v, want %v", emails, want)
+	}
+}
+
+func TestSearchLDAPEmails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the directory switches to TLS with the certificate of a test server the client trusts
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	transport := http.DefaultTransport.(*http.Transport)
+	clientConfig := transport.TLSClientConfig
+	transport.TLSClientConfig = tlsServer.Client().Transport.(*http.Transport).TLSClientConfig
+	t.Cleanup(func() { transport.TLSClientConfig = clientConfig })
+
+	// the directory returns its entries in two pages
+	pages := [][]string{{"steph@warriors.com", "klay@warriors.com"}, {"draymond@warriors.com"}}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { conn.Close() }()
+		encrypted := false
+		reply := func(id int64, op *ber.Packet, controls ...*ber.Packet) {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			envelope.AppendChild(op)
+			if len(controls) > 0 {
+				wrapper := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "")
+				for _, control := range controls {
+					wrapper.AppendChild(control)
+				}
+				envelope.AppendChild(wrapper)
+			}
+			conn.Write(envelope.Bytes())
+		}
+		result := func(tag ber.Tag, code int64, message string) *ber.Packet {
+			op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+			op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+			op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+			op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, ""))
+			return op
+		}
+		page := 0
+		for {
+			msg, err := ber.ReadPacket(conn)
+			if err != nil || len(msg.Children) < 2 {
+				return
+			}
+			id, _ := msg.Children[0].Value.(int64)
+			switch msg.Children[1].Tag {
+			case ldap.ApplicationExtendedRequest:
+				reply(id, result(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess, ""))
+				tlsConn := tls.Server(conn, tlsServer.TLS)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				conn, encrypted = tlsConn, true
+			case ldap.ApplicationBindRequest:
+				if !encrypted {
+					reply(id, result(ldap.ApplicationBindResponse, ldap.LDAPResultConfidentialityRequired, "confidentiality required"))
+					continue
+				}
+				reply(id, result(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, ""))
+			case ldap.ApplicationSearchRequest:
+				for i, email := range pages[page] {
+					entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+					entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, fmt.Sprintf("uid=%d,dc=warriors,dc=com", i), ""))
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "mail", ""))
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, email, ""))
+					attribute.AppendChild(values)
+					attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attributes.AppendChild(attribute)
+					entry.AppendChild(attributes)
+					reply(id, entry)
+				}
+				// the paging control of every page but the last has the cookie to ask for the next one with
+				page++
+				paging := ldap.NewControlPaging(0)
+				if page < len(pages) {
+					paging.SetCookie([]byte("next"))
+				}
+				reply(id, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""), paging.Encode())
+			case ldap.ApplicationUnbindRequest:
+				return
+			}
+		}
+	}()
+
+	emails, err := searchLDAPEmails("ldap://"+listener.Addr().String(), "cn=invites,dc=warriors,dc=com", "secret", "dc=warriors,dc=com", "(objectClass=person)", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"steph@warriors.com", "klay@warriors.com", "draymond@warriors.com"}; !slices.Equal(emails, want) {
+		t.Errorf("got emails %v, want %v", emails, want)
+	}
+
+	if _, err := searchLDAPEmails("ldap://"+listener.Addr().String(), "", "", "dc=warriors,dc=com", "(mail=*", "mail"); err == nil {
+		t.Error("expected an error for an invalid filter")
+	}
+}
+
+func TestGetGitHubTeamEmails(t *testing.T) {
+	pages := []string{
+		`{"data": {"organization": {"team": {"members": {"nodes": [
+			{"login": "stephcurry", "email": "wardell@gmail.com", "organizationVerifiedDomainEmails": ["steph@warriors.com"]},
+			{"login": "klay", "email": "klay@warriors.com", "organizationVerifiedDomainEmails": []},
+			{"login": "anon", "email": "", "organizationVerifiedDomainEmails": []}
+		], "pageInfo": {"hasNextPage": true, "endCursor": "c1"}}}}}}`,
+		`{"data": {"organization": {"team": {"members": {"nodes": [
+			{"login": "draymond", "email": "", "organizationVerifiedDomainEmails": ["draymond@warriors.com"]}
+		], "pageInfo": {"hasNextPage": false, "endCursor": "c2"}}}}}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Variables map[string]interface{} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Variables["org"] != "warriors" || body.Variables["team"] != "platform" {
+			t.Errorf("got variables %v", body.Variables)
+		}
+		page := 0
+		if body.Variables["cursor"] == "c1" {
+			page = 1
+		}
+		io.WriteString(w, pages[page])
+	}))
+	defer server.Close()
+	out := logs.out
+	logs.out = io.Discard
+	defer func() { logs.out = out }()
+
+	emails, err := getGitHubTeamEmails(server.URL, "ghp-test", "warriors/platform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"steph@warriors.com", "klay@warriors.com", "draymond@warriors.com"}; !slices.Equal(emails, want) {
+		t.Errorf("got emails %v, want %v", emails, want)
+	}
+	if _, err := getGitHubTeamEmails(server.URL, "ghp-test", "platform"); err == nil {
+		t.Error("expected an error for a team without an org")
+	}
+}
+
+func TestAPIServer(t *testing.T) {
+	mock := startTestSlack(t)
+	server := httptest.NewServer((&apiServer{slackToken: testToken, authToken: "serve-token", merge: mergeUnion, parallel: 2, opts: runOptions{batchSize: maxInviteBatchSize}}).handler())
+	defer server.Close()
+
+	call := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := call(http.MethodGet, "/channels", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d without the right token, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp := call(http.MethodPost, "/invite", "serve-token", `{"emails": ["klay@warriors.com", "draymond@warriors.com"], "channels": ["dubnation"]}`)
+	var invited serveChangeResponse
+	json.NewDecoder(resp.Body).Decode(&invited)
+	if resp.StatusCode != http.StatusOK || invited.Summary.Invited != 1 || !slices.Equal(invited.NotFound, []string{"draymond@warriors.com"}) {
+		t.Errorf("got status %d and %+v, want 1 invited and draymond not found", resp.StatusCode, invited)
+	}
+	if members := mock.channel("C0DUB").Members; !slices.Contains(members, "U0KLAY") {
+		t.Errorf("U0KLAY wasn't invited, members are %v", members)
+	}
+
+	resp = call(http.MethodGet, "/audit?emails=klay@warriors.com&channels=dubnation,splashbrothers,warriors", "serve-token", "")
+	var audit serveAuditResponse
+	json.NewDecoder(resp.Body).Decode(&audit)
+	if !slices.Equal(audit.Missing["splashbrothers"], []string{"U0KLAY"}) || len(audit.Missing["dubnation"]) != 0 || !slices.Equal(audit.ChannelsNotFound, []string{"warriors"}) {
+		t.Errorf("got audit %+v", audit)
+	}
+
+	if resp := call(http.MethodGet, "/invite", "serve-token", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for GET /invite, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAPIServerIdempotencyKey(t *testing.T) {
+	mock := startTestSlack(t)
+	server := httptest.NewServer((&apiServer{slackToken: testToken, authToken: "serve-token", merge: mergeUnion, parallel: 2, opts: runOptions{batchSize: maxInviteBatchSize}}).handler())
+	defer server.Close()
+
+	call := func(key, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/invite", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer serve-token")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	body := `{"emails": ["klay@warriors.com"], "channels": ["dubnation"]}`
+	call("invite-klay", body)
+	// drop klay again, so a second invite would show
+	dub := mock.channel("C0DUB")
+	if i := slices.Index(dub.Members, "U0KLAY"); i >= 0 {
+		dub.Members = slices.Delete(dub.Members, i, i+1)
+	}
+
+	resp := call("invite-klay", body)
+	var replayed serveChangeResponse
+	json.NewDecoder(resp.Body).Decode(&replayed)
+	if resp.Header.Get("Idempotent-Replayed") != "true" || replayed.Summary.Invited != 1 {
+		t.Errorf("got headers %v and %+v, want the replayed response with 1 invited", resp.Header, replayed)
+	}
+	if slices.Contains(dub.Members, "U0KLAY") {
+		t.Error("U0KLAY was invited again for a repeated Idempotency-Key")
+	}
+
+	if resp := call("invite-klay", `{"emails": ["steph@warriors.com"], "channels": ["dubnation"]}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for a reused Idempotency-Key, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+	if call("invite-klay-again", body); !slices.Contains(dub.Members, "U0KLAY") {
+		t.Error("U0KLAY wasn't invited for a new Idempotency-Key")
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// Wednesday
+	now := time.Date(2026, 10, 14, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"0 7 * * *", time.Date(2026, 10, 15, 7, 0, 0, 0, time.UTC)},
+		{"*/20 8 * * *", time.Date(2026, 10, 14, 8, 40, 0, 0, time.UTC)},
+		{"0 9-17/4 * * 1-5", time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)},
+		{"0 7 * * 6,7", time.Date(2026, 10, 17, 7, 0, 0, 0, time.UTC)},
+		// either the 1st or a Monday
+		{"0 0 1 * 1", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.spec)
+		if err != nil {
+			t.Fatalf("%s: %s", test.spec, err)
+		}
+		if got := schedule.next(now); !got.Equal(test.want) {
+			t.Errorf("%s: got next run %s, want %s", test.spec, got, test.want)
+		}
+	}
+
+	for _, spec := range []string{"0 7 * *", "60 * * * *", "0 7-5 * * *", "*/0 * * * *", "0 7 * jan *"} {
+		if _, err := parseCronSchedule(spec); err == nil {
+			t.Errorf("expected an error for -schedule '%s'", spec)
+		}
+	}
+}
+
+func TestRerunArgs(t *testing.T) {
+	start := time.Date(2026, 10, 15, 7, 0, 0, 0, time.UTC)
+	args := []string{"sync", "-from_usergroup=oncall", "-schedule", "0 7 * * *", "-summary_file", "summary.json", "-watch", "-channels=incidents"}
+	got := rerunArgs(args, start, "summary.json", "")
+	want := []string{"sync", "-summary_file=summary-20261015T0700.json", "-from_usergroup=oncall", "-channels=incidents"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got args %q, want %q", got, want)
+	}
+}
+
+// signedSlackRequest returns a POST request of body to url, signed with secret like Slack signs its requests.
+func signedSlackRequest(t *testing.T, url, secret, body string) *http.Request {
+	t.Helper()
+	timestamp := fmt.Sprint(time.Now().Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestSlashCommand(t *testing.T) {
+	mock := startTestSlack(t)
+	answers := make(chan string, 2)
+	responses := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var answer slashCommandResponse
+		json.NewDecoder(r.Body).Decode(&answer)
+		answers <- answer.Text
+	}))
+	defer responses.Close()
+	server := httptest.NewServer((&apiServer{slackToken: testToken, signingSecret: "signing-secret", merge: mergeUnion, parallel: 2, opts: runOptions{batchSize: maxInviteBatchSize}}).handler())
+	defer server.Close()
+
+	command := func(userID, text, secret string) int {
+		body := url.Values{"command": {"/bulk-invite"}, "text": {text}, "user_id": {userID}, "response_url": {responses.URL}}.Encode()
+		resp, err := http.DefaultClient.Do(signedSlackRequest(t, server.URL+"/slack/commands", secret, body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	answer := func() string {
+		select {
+		case text := <-answers:
+			return text
+		case <-time.After(5 * time.Second):
+			t.Fatal("no answer posted to the response_url")
+			return ""
+		}
+	}
+
+	if status := command("U0STEPH", "#dubnation klay@warriors.com", "wrong-secret"); status != http.StatusUnauthorized {
+		t.Errorf("got status %d with a bad signature, want %d", status, http.StatusUnauthorized)
+	}
+
+	// U0KLAY isn't a member of dubnation yet
+	command("U0KLAY", "<#C0DUB|dubnation> <mailto:klay@warriors.com|klay@warriors.com>", "signing-secret")
+	if text := answer(); !strings.Contains(text, "need to be a member of #dubnation") {
+		t.Errorf("got answer %q, want the user to be refused", text)
+	}
+
+	command("U0STEPH", "<#C0DUB|> <mailto:klay@warriors.com|klay@warriors.com>,draymond@warriors.com", "signing-secret")
+	if text := answer(); !strings.Contains(text, "Invited 1 users to #dubnation") || !strings.Contains(text, "Not found: draymond@warriors.com") {
+		t.Errorf("got answer %q, want klay invited and draymond not found", text)
+	}
+	if members := mock.channel("C0DUB").Members; !slices.Contains(members, "U0KLAY") {
+		t.Errorf("U0KLAY wasn't invited, members are %v", members)
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	mock := startTestSlack(t)
+	server := &apiServer{slackToken: testToken, botToken: "xoxb-test", merge: mergeUnion, parallel: 2, opts: runOptions{batchSize: maxInviteBatchSize}}
+	// the test plays Slack's side of the connection
+	slackConns := make(chan *websocket.Conn, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err == nil {
+			slackConns <- conn
+		}
+	}))
+	defer peer.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(peer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slack := <-slackConns
+	defer slack.Close()
+	pongs := make(chan string, 1)
+	slack.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+	done := make(chan error, 1)
+	go func() { done <- server.handleSocketMode(client) }()
+
+	slack.WriteMessage(websocket.TextMessage, []byte(`{"type": "hello"}`))
+	slack.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second))
+	event := `{"envelope_id": "env-1", "type": "events_api", "payload": {"event": {"type": "message", "channel": "D0MOCK", "channel_type": "im", "user": "U0STEPH", "text": "#dubnation <mailto:klay@warriors.com|klay@warriors.com>", "ts": "1700000200.000300"}}}`
+	slack.WriteMessage(websocket.TextMessage, []byte(event))
+	_, ack, err := slack.ReadMessage()
+	if err != nil || string(ack) != `{"envelope_id":"env-1"}` {
+		t.Fatalf("got ack %q and error %v, want the envelope acknowledged", ack, err)
+	}
+	// the ping was sent before the event, so it was answered before the ack
+	select {
+	case data := <-pongs:
+		if data != "ping" {
+			t.Errorf("got pong %q, want \"ping\"", data)
+		}
+	default:
+		t.Error("the ping wasn't answered")
+	}
+	slack.WriteMessage(websocket.TextMessage, []byte(`{"type": "disconnect", "reason": "refresh_requested"}`))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if members := mock.channel("C0DUB").Members; !slices.Contains(members, "U0KLAY") {
+		t.Errorf("U0KLAY wasn't invited, members are %v", members)
+	}
+	if len(mock.posted) != 1 || mock.posted[0].ThreadTS != "1700000200.000300" || !strings.Contains(mock.posted[0].Text, "Invited 1 users to #dubnation") {
+		t.Errorf("got posted messages %+v, want the outcome in the thread of the direct message", mock.posted)
+	}
+}
+
+func TestSocketModeDeadConnection(t *testing.T) {
+	startTestSlack(t)
+	timeout := socketModeTimeout
+	socketModeTimeout = 100 * time.Millisecond
+	defer func() { socketModeTimeout = timeout }()
+
+	// Slack's side never reads, so the client's pings go unanswered
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(&websocket.Upgrader{}).Upgrade(w, r, nil)
+	}))
+	defer peer.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(peer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := &apiServer{slackToken: testToken}
+	done := make(chan error, 1)
+	go func() { done <- server.handleSocketMode(client) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("got no error, want the silent connection taken for dead")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the silent connection was never given up on")
+	}
+}
+
+func TestSocketModeRetriesConnecting(t *testing.T) {
+	startTestSlack(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	requestCtx = ctx
+	defer func() { requestCtx = context.Background() }()
+
+	// the mock doesn't implement apps.connections.open, so every attempt fails
+	server := &apiServer{appToken: "xapp-test"}
+	done := make(chan error, 1)
+	go func() { done <- server.socketMode() }()
+	select {
+	case err := <-done:
+		t.Fatalf("got %v, want socketMode to keep retrying", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("got error %v, want none once cancelled", err)
+	}
+}
+
+func TestTeamJoin(t *testing.T) {
+	mock := startTestSlack(t)
+	joinChannels, err := parseJoinChannels("splashbrothers; warriors.com=#dubnation ;nets.com=front-office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &apiServer{slackToken: testToken, signingSecret: "signing-secret", joinChannels: joinChannels, merge: mergeUnion, parallel: 2, opts: runOptions{batchSize: maxInviteBatchSize}}
+	httpServer := httptest.NewServer(server.handler())
+	defer httpServer.Close()
+
+	resp, err := http.DefaultClient.Do(signedSlackRequest(t, httpServer.URL+"/slack/events", "signing-secret", `{"type": "url_verification", "challenge": "c0ffee"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var verification map[string]string
+	json.NewDecoder(resp.Body).Decode(&verification)
+	if verification["challenge"] != "c0ffee" {
+		t.Errorf("got %v, want the challenge echoed", verification)
+	}
+
+	var event slackEvent
+	err = json.Unmarshal([]byte(`{"type": "team_join", "user": {"id": "U0KLAY", "profile": {"email": "Klay@Warriors.com"}}}`), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.handleEvent(event)
+	for _, channelID := range []string{"C0SPLASH", "C0DUB"} {
+		if members := mock.channel(channelID).Members; !slices.Contains(members, "U0KLAY") {
+			t.Errorf("U0KLAY wasn't invited to %s, members are %v", channelID, members)
+		}
+	}
+	if members := mock.channel("C0FRONT").Members; slices.Contains(members, "U0KLAY") {
+		t.Errorf("U0KLAY was invited to the channels of another domain, members are %v", members)
+	}
+
+	if _, err := parseJoinChannels("warriors.com="); err == nil {
+		t.Error("expected an error for a domain without channels")
+	}
+}
+
+func TestUndoLastRun(t *testing.T) {
+	mock := startTestSlack(t)
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	journal = &runJournal{path: path, run: "run-1"}
+	t.Cleanup(func() { journal = nil })
+
+	if _, _, err := inviteUsersInBatches(testToken, []string{"U0KLAY"}, "C0DUB", "dubnation", maxInviteBatchSize, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := removeUsersFromChannel(testToken, []string{"U0STEPH"}, "C0DUB", "dubnation", false); err != nil {
+		t.Fatal(err)
+	}
+
+	journal = &runJournal{path: path, run: "run-2"}
+	summary := &runSummary{Action: actionUndo}
+	if err := undoLastRun(testToken, path, time.Hour, false, false, false, summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Invited != 1 || summary.Removed != 1 {
+		t.Errorf("got %d invited and %d removed, want 1 of each", summary.Invited, summary.Removed)
+	}
+	if members := mock.channel("C0DUB").Members; slices.Contains(members, "U0KLAY") {
+		t.Errorf("U0KLAY is still in dubnation, members are %v", members)
+	}
+	if members := mock.channel("C0DUB").Members; !slices.Contains(members, "U0STEPH") {
+		t.Errorf("U0STEPH wasn't invited back to dubnation, members are %v", members)
+	}
+
+	// neither the undo nor the run it reversed are undone again
+	if err := undoLastRun(testToken, path, time.Hour, false, false, false, &runSummary{}); err == nil {
+		t.Error("expected nothing left to undo")
+	}
+
+	stale := filepath.Join(t.TempDir(), "journal.jsonl")
+	err := os.WriteFile(stale, []byte(`{"run": "old", "time": "2020-01-01T00:00:00Z", "action": "add", "channel_id": "C0DUB", "channel": "dubnation", "user": "U0STEPH"}`+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := undoLastRun(testToken, stale, time.Hour, false, false, false, &runSummary{}); err == nil || !strings.Contains(err.Error(), "-undo_window") {
+		t.Errorf("got error %v, want the run to be outside -undo_window", err)
+	}
+}
+
+func TestUndoKeepsPriorMembers(t *testing.T) {
+	mock := startTestSlack(t)
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	journal = &runJournal{path: path, run: "run-1"}
+	t.Cleanup(func() { journal = nil })
+
+	invited, _, err := inviteUsersInBatches(testToken, []string{"U0STEPH", "U0KLAY"}, "C0DUB", "dubnation", maxInviteBatchSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(invited, []string{"U0KLAY"}) {
+		t.Errorf("got users invited %v, want only U0KLAY", invited)
+	}
+	if _, _, err := inviteUsersToChannelPaced(testToken, []string{"U0ADMIN", "U0SETH"}, "C0SPLASH", "splashbrothers", time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+
+	journal = &runJournal{path: path, run: "run-2"}
+	if err := undoLastRun(testToken, path, time.Hour, false, false, false, &runSummary{Action: actionUndo}); err != nil {
+		t.Fatal(err)
+	}
+	// steph and bob were members before the run, so undoing it leaves them in
+	if members := mock.channel("C0DUB").Members; !slices.Contains(members, "U0STEPH") || slices.Contains(members, "U0KLAY") {
+		t.Errorf("got dubnation members %v, want U0STEPH kept and U0KLAY removed", members)
+	}
+	if members := mock.channel("C0SPLASH").Members; !slices.Contains(members, "U0ADMIN") || slices.Contains(members, "U0SETH") {
+		t.Errorf("got splashbrothers members %v, want U0ADMIN kept and U0SETH removed", members)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	startTestSlack(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auth, err := getAuthInfo(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog, err = openAuditLog(path, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog = nil })
+
+	if _, _, err := inviteUsersInBatches(testToken, []string{"U0KLAY", "U0NOBODY"}, "C0DUB", "dubnation", maxInviteBatchSize, false); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].SlackUserID != "U0ADMIN" || entries[0].TeamID != "T0MOCK" || entries[0].User != "U0KLAY" || entries[1].Result != "failed" {
+		t.Errorf("got entries %+v, want KLAY invited and U0NOBODY failed, attributed to U0ADMIN", entries)
+	}
+	if count, err := verifyAuditLog(path); err != nil || count != 2 {
+		t.Errorf("got %d entries and error %v, want an intact log of 2 entries", count, err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, bytes.Replace(contents, []byte("U0KLAY"), []byte("U0SETH"), 1), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAuditLog(path); err == nil {
+		t.Error("expected the modified log to fail verification")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	startTestSlack(t)
+	metrics = &metricsRegistry{Counters: map[string]float64{}, Histograms: map[string]*histogram{}}
+
+	if _, _, err := inviteUsersInBatches(testToken, []string{"U0KLAY", "U0NOBODY"}, "C0DUB", "dubnation", maxInviteBatchSize, false); err != nil {
+		t.Fatal(err)
+	}
+	// a scheduled run hands over the metrics of its own invites
+	metrics.merge(&metricsRegistry{Counters: map[string]float64{metricSeries("slack_invite_operations_total", "action", actionAdd, "result", "ok"): 2}})
+
+	var exposition strings.Builder
+	metrics.write(&exposition)
+	for _, want := range []string{
+		"# TYPE slack_invite_operations_total counter\n",
+		`slack_invite_operations_total{action="` + actionAdd + `",result="failed"} 1` + "\n",
+		`slack_invite_operations_total{action="` + actionAdd + `",result="ok"} 3` + "\n",
+		"# TYPE slack_api_request_duration_seconds histogram\n",
+		`slack_api_request_duration_seconds_bucket{method="conversations.invite",le="+Inf"} `,
+		`slack_api_requests_total{method="conversations.invite"} `,
+	} {
+		if !strings.Contains(exposition.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, exposition.String())
+		}
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	mock := startTestSlack(t)
+	mock.fixture.Scopes = "channels:read, channels:manage,users:read"
+	auth, err := getAuthInfo(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	needed := requiredScopes(actionAdd, true, false, true, false, false, false, false, false)
+	missing := missingScopes(auth.Scopes, needed)
+	want := []string{"users:read.email", "groups:read", "groups:write or groups:write.invites"}
+	if !slices.Equal(missing, want) {
+		t.Errorf("got missing scopes %q, want %q", missing, want)
+	}
+	if missing := missingScopes(auth.Scopes, requiredScopes(actionRemove, false, false, false, false, false, false, false, false)); len(missing) > 0 {
+		t.Errorf("got missing scopes %q, want channels:manage to be enough to remove users", missing)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	startTestSlack(t)
+	auth, err := getAuthInfo(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := identity(auth); got != "bob (U0ADMIN)" {
+		t.Errorf("got identity %q, want bob (U0ADMIN)", got)
+	}
+	auth.BotID = "B0BOT"
+	if got := identity(auth); got != "bot B0BOT of bob (U0ADMIN)" {
+		t.Errorf("got identity %q, want the bot of bob", got)
+	}
+}
+
+func TestChildArgsForTeam(t *testing.T) {
+	startTestSlack(t)
+	teams, err := listOrgTeams(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(teams) != 1 || teams[0].ID != "T0MOCK" {
+		t.Fatalf("got teams %+v, want the mock workspace", teams)
+	}
+
+	args := []string{"invite", "-all_teams", "-team_id", "T0OLD", "-summary_file=summary.json", "-channels=dubnation"}
+	got := childArgs(args, map[string]bool{"all_teams": false, "team_id": true, "summary_file": true}, []string{"-team_id=" + teams[0].ID, "-summary_file=" + suffixedPath("summary.json", teams[0].ID)})
+	want := []string{"invite", "-team_id=T0MOCK", "-summary_file=summary-T0MOCK.json", "-channels=dubnation"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOrgWideChannels(t *testing.T) {
+	mock := startTestSlack(t)
+	mock.fixture.Channels = append(mock.fixture.Channels, mockChannel{channel: channel{ID: "C0ORG", Name: "warriors-org"}, OrgWide: true})
+	adminConversations = true
+	t.Cleanup(func() {
+		adminConversations = false
+		orgChannels = &channelSet{ids: map[string]bool{}}
+	})
+
+	channels, err := getChannelsCached(testToken, false, false, false, false, "", 0, []string{"dubnation", "warriors-org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channels["warriors-org"] != "C0ORG" {
+		t.Fatalf("got channels %v, want the org-wide channel to be found", channels)
+	}
+	if _, _, err := inviteUsersInBatches(testToken, []string{"U0KLAY"}, "C0ORG", "warriors-org", maxInviteBatchSize, false); err != nil {
+		t.Fatal(err)
+	}
+	if members := mock.channel("C0ORG").Members; !slices.Contains(members, "U0KLAY") {
+		t.Errorf("U0KLAY wasn't invited to the org-wide channel, members are %v", members)
+	}
+}
+
+func TestChannelCacheIsPerTeam(t *testing.T) {
+	startTestSlack(t)
+	path := filepath.Join(t.TempDir(), "channels.json")
+	t.Cleanup(func() { workspaceTeamID = "" })
+
+	workspaceTeamID = "T0OTHER"
+	contents, err := json.Marshal(channelCache{Types: "private=false,mpim=false,archived=false,team=T0OTHER", FetchedAt: time.Now(), Channels: map[string]string{"otherteam": "C0OTHER"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	channels, err := getChannelsFromCache(testToken, false, false, false, false, path, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channels["otherteam"] != "C0OTHER" {
+		t.Errorf("got channels %v, want the cached ones of the same team", channels)
+	}
+
+	workspaceTeamID = "T0DUBS"
+	channels, err = getChannelsFromCache(testToken, false, false, false, false, path, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := channels["otherteam"]; ok || channels["dubnation"] != "C0DUB" {
+		t.Errorf("got channels %v, want those listed for the team instead of the cache of another one", channels)
+	}
+}
+
+func TestResolveChannelRefs(t *testing.T) {
+	startTestSlack(t)
+	names, ids, all, err := resolveChannelRefs(testToken, []string{"C0DUB", "https://warriors.slack.com/archives/C0SPLASH", "front-office", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dubnation", "splashbrothers", "front-office", ""}; !slices.Equal(names, want) {
+		t.Errorf("got channels %q, want %q", names, want)
+	}
+	if ids["dubnation"] != "C0DUB" || ids["splashbrothers"] != "C0SPLASH" || len(ids) != 2 || all {
+		t.Errorf("got IDs %v (all: %t), want only dubnation and splashbrothers", ids, all)
+	}
+}
+
+func TestWithoutExcluded(t *testing.T) {
+	startTestSlack(t)
+	excluded, _ := getUsersIdsFrom(testToken, "steph@warriors.com,U0KLAY", mergeUnion)
+	for _, userID := range excluded {
+		excludedUsers[userID] = true
+	}
+	t.Cleanup(func() { excludedUsers = map[string]bool{} })
+
+	got := withoutExcluded([]string{"U0ADMIN", "U0STEPH", "U0SETH", "U0KLAY"})
+	if want := []string{"U0ADMIN", "U0SETH"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExportMembershipsWithoutBots(t *testing.T) {
+	startTestSlack(t)
+	channelNameToIDMap := map[string]string{"dubnation": "C0DUB"}
+	for _, includeBots := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "memberships.csv")
+		if err := exportMemberships(testToken, []string{"dubnation"}, channelNameToIDMap, path, 1, includeBots, false); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exported := strings.Contains(string(contents), "B0BOT"); exported != includeBots {
+			t.Errorf("with include_bots %t, got B0BOT exported %t:\n%s", includeBots, exported, contents)
+		}
+		if !strings.Contains(string(contents), "U0STEPH") {
+			t.Errorf("U0STEPH is missing from the export:\n%s", contents)
+		}
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	mock := startTestSlack(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `ignore:
+  - bots: true
+  - channels: ["#front-*"]
+    users: ["steph@*"]
+  - channels: [dubnation]
+    users: [U0KLAY]
+`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyProfile(path, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ignoreRules = nil })
+
+	channelNameToIDMap := map[string]string{"dubnation": "C0DUB", "front-office": "C0FRONT"}
+	channels := []string{"dubnation", "front-office"}
+	missing, err := findMissingMembers(testToken, []string{"U0STEPH", "U0KLAY"}, channels, channelNameToIDMap, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing["dubnation"]) != 0 || !slices.Equal(missing["front-office"], []string{"U0KLAY"}) {
+		t.Errorf("got missing members %v, want none in dubnation and U0KLAY in front-office", missing)
+	}
+
+	purgeChannels(testToken, channels, channelNameToIDMap, []string{"U0ADMIN"}, true, false, false, false, &runSummary{Action: actionPurge})
+	if members := mock.channel("C0DUB").Members; !slices.Equal(members, []string{"U0ADMIN", "B0BOT"}) {
+		t.Errorf("got dubnation members %v, want U0ADMIN and B0BOT", members)
+	}
+	if members := mock.channel("C0FRONT").Members; !slices.Equal(members, []string{"U0ADMIN", "U0STEPH"}) {
+		t.Errorf("got front-office members %v, want U0ADMIN and U0STEPH", members)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+func (s *apiStats) record(endpoint string, waited time.Duration, rateLimited bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.endpoints[endpoint]
+	if !ok {
+		stats = &endpointStats{Endpoint: endpoint, first: time.Now()}
+		s.endpoints[endpoint] = stats
+	}
+	stats.Requests++
+	stats.WaitSeconds += waited.Seconds()
+	if rateLimited {
+		stats.RateLimited++
+	}
+	stats.last = time.Now()
+}
+
+// snapshot returns the statistics of every endpoint sorted by name, including the effective request rate.
+func (s *apiStats) snapshot() []endpointStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make([]endpointStats, 0, len(s.endpoints))
+	for _, stats := range s.endpoints {
+		entry := *stats
+		if elapsed := entry.last.Sub(entry.first); entry.Requests > 1 && elapsed > 0 {
+			entry.RequestsPerMinute = float64(entry.Requests-1) / elapsed.Minutes()
+		}
+		snapshot = append(snapshot, entry)
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Endpoint < snapshot[j].Endpoint
+	})
+	return snapshot
+}
+
+// metricSeries returns the name of a series of the metric with the label name and value pairs.
+func metricSeries(name string, labels ...string) string {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricsRegistry) add(series string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Counters[series] += value
+}
+
+// observeRequest records a Slack API request: its latency, the time waited before sending it, whether
+// Slack rate limited it and the error it answered with.
+func (m *metricsRegistry) observeRequest(method string, latency, waited time.Duration, rateLimited bool, slackErr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Counters[metricSeries("slack_api_requests_total", "method", method)]++
+	m.Counters[metricSeries("slack_api_wait_seconds_total", "method", method)] += waited.Seconds()
+	if rateLimited {
+		m.Counters[metricSeries("slack_api_rate_limited_total", "method", method)]++
+	}
+	if slackErr != "" {
+		m.Counters[metricSeries("slack_api_errors_total", "method", method, "error", slackErr)]++
+	}
+
+	series := metricSeries("slack_api_request_duration_seconds", "method", method)
+	h := m.Histograms[series]
+	if h == nil {
+		h = &histogram{Buckets: make([]float64, len(latencyBuckets)+1)}
+		m.Histograms[series] = h
+	}
+	bucket := sort.SearchFloat64s(latencyBuckets, latency.Seconds())
+	h.Buckets[bucket]++
+	h.Sum += latency.Seconds()
+	h.Count++
+}
+
+// merge adds the counters and histograms of other, e.g. those of a run started by -schedule.
+func (m *metricsRegistry) merge(other *metricsRegistry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for series, value := range other.Counters {
+		m.Counters[series] += value
+	}
+	for series, h := range other.Histograms {
+		if len(h.Buckets) != len(latencyBuckets)+1 {
+			continue
+		}
+		total := m.Histograms[series]
+		if total == nil {
+			total = &histogram{Buckets: make([]float64, len(latencyBuckets)+1)}
+			m.Histograms[series] = total
+		}
+		for i, count := range h.Buckets {
+			total.Buckets[i] += count
+		}
+		total.Sum += h.Sum
+		total.Count += h.Count
+	}
+}
+
+// write writes the metrics in the Prometheus text exposition format.
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	families := map[string][]string{}
+	for series := range m.Counters {
+		name, _, _ := strings.Cut(series, "{")
+		families[name] = append(families[name], series)
+	}
+	for series := range m.Histograms {
+		name, _, _ := strings.Cut(series, "{")
+		families[name] = append(families[name], series)
+	}
+	names := maps.Keys(families)
+	sort.Strings(names)
+	for _, name := range names {
+		series := families[name]
+		sort.Strings(series)
+		fmt.Fprintf(w, "# HELP %s %s\n", name, metricHelp[name])
+		if _, ok := m.Histograms[series[0]]; !ok {
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+			for _, s := range series {
+				fmt.Fprintf(w, "%s %s\n", s, strconv.FormatFloat(m.Counters[s], 'f', -1, 64))
+			}
+			continue
+		}
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for _, s := range series {
+			h := m.Histograms[s]
+			labels := strings.TrimSuffix(strings.TrimPrefix(s, name+"{"), "}")
+			if labels != "" {
+				labels += ","
+			}
+			cumulative := 0.0
+			for i, count := range h.Buckets {
+				cumulative += count
+				le := "+Inf"
+				if i < len(latencyBuckets) {
+					le = strconv.FormatFloat(latencyBuckets[i], 'f', -1, 64)
+				}
+				fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %s\n", name, labels, le, strconv.FormatFloat(cumulative, 'f', -1, 64))
+			}
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", name, strings.TrimSuffix(labels, ","), strconv.FormatFloat(h.Sum, 'f', -1, 64))
+			fmt.Fprintf(w, "%s_count{%s} %s\n", name, strings.TrimSuffix(labels, ","), strconv.FormatFloat(h.Count, 'f', -1, 64))
+		}
+	}
+}
+
+// handOver writes the metrics to $SLACK_INVITE_METRICS_FILE when the run was started by -schedule or -watch,
+// for the parent to serve.
+func (m *metricsRegistry) handOver() {
+	path := os.Getenv(metricsFileEnvVar)
+	if path == "" {
+		return
+	}
+	m.mu.Lock()
+	contents, err := json.Marshal(m)
+	m.mu.Unlock()
+	if err == nil {
+		err = os.WriteFile(path, contents, 0600)
+	}
+	if err != nil {
+		logWarn("Unable to hand the metrics over: %s", err)
+	}
+}
+
+// serveMetrics starts serving the metrics on addr at /metrics, in the background until ctx is done. It only
+// fails if it can't listen on addr.
+func serveMetrics(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Unable to serve metrics: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	go server.Serve(listener)
+	logInfo("Serving metrics on http://%s/metrics", listener.Addr())
+	return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// recordMockFixture writes the workspace's users and channels, with the members of the given channels (or of
+// all channels if none are given), to a fixture for -mock.
+func recordMockFixture(apiToken string, channels []string, private, archived bool, path string, debug bool) error {
+	auth, err := getAuthInfo(apiToken)
+	if err != nil {
+		return err
+	}
+	users, err := listUsers(apiToken)
+	if err != nil {
+		return err
+	}
+	fixture := mockFixture{Team: auth.Team, UserID: auth.UserID, Users: users, Scopes: strings.Join(auth.Scopes, ",")}
+
+	err = forEachChannel(apiToken, private, false, archived, debug, func(c channel) error {
+		if len(channels) > 0 && !slices.Contains(channels, c.Name) {
+			return nil
+		}
+		fixture.Channels = append(fixture.Channels, mockChannel{channel: c, Members: []string{}})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range fixture.Channels {
+		c := &fixture.Channels[i]
+		logInfo("[%d/%d] Recording members of '%s'", i+1, len(fixture.Channels), c.Name)
+		err := forEachMember(apiToken, c.ID, debug, func(member string) error {
+			c.Members = append(c.Members, member)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Error while listing members of '%s': %s", c.Name, err)
+		}
+	}
+
+	contents, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, contents, 0644)
+	if err != nil {
+		return err
+	}
+	logInfo("%d users and %d channels recorded to %s", len(fixture.Users), len(fixture.Channels), path)
+	return nil
+}
+
+// startMockSlack serves the fixture at path as the Slack API on a local server and points all API calls at it.
+func startMockSlack(path string) (*httptest.Server, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read mock fixture: %s", err)
+	}
+	var fixture mockFixture
+	err = json.Unmarshal(contents, &fixture)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse mock fixture %s: %s", path, err)
+	}
+
+	server := httptest.NewServer(&mockSlack{fixture: fixture})
+	apiBaseURL, err = url.Parse(server.URL)
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+func (m *mockSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the script sends parameters in the query string or as a JSON body
+	params := map[string]string{}
+	for name, values := range r.URL.Query() {
+		params[name] = values[0]
+	}
+	if r.Body != nil {
+		var body map[string]interface{}
+		if json.NewDecoder(r.Body).Decode(&body) == nil {
+			for name, value := range body {
+				params[name] = fmt.Sprint(value)
+			}
+		}
+	}
+
+	method := path.Base(r.URL.Path)
+	response := m.handle(method, params)
+	if slackErr := m.fixture.Errors[method]; slackErr != "" {
+		response = map[string]interface{}{"ok": false, "error": slackErr}
+	}
+	if method == "auth.test" && m.fixture.Scopes != "" {
+		w.Header().Set("X-OAuth-Scopes", m.fixture.Scopes)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handle runs a Slack API method against the fixture and returns its response.
+func (m *mockSlack) handle(method string, params map[string]string) interface{} {
+	fail := func(slackErr string) interface{} {
+		return map[string]interface{}{"ok": false, "error": slackErr}
+	}
+	noMore := responseMetadata{}
+
+	switch method {
+	case "auth.test":
+		auth := authTestResponse{Ok: true, URL: "https://mock.slack.com/", Team: m.fixture.Team, UserID: m.fixture.UserID, TeamID: "T0MOCK", EnterpriseID: m.fixture.EnterpriseID}
+		if u := m.user(m.fixture.UserID); u != nil {
+			auth.User = u.Name
+		}
+		return auth
+	case "admin.teams.list":
+		return adminTeamsListResponse{Ok: true, Teams: []team{{ID: "T0MOCK", Name: m.fixture.Team}}, ResponseMetadata: noMore}
+	case "users.list":
+		return usersListResponse{Ok: true, Members: m.fixture.Users, ResponseMetadata: noMore}
+	case "users.info":
+		u := m.user(params["user"])
+		if u == nil {
+			return fail("user_not_found")
+		}
+		return usersLookupResponse{Ok: true, User: *u}
+	case "users.lookupByEmail":
+		for _, u := range m.fixture.Users {
+			if strings.EqualFold(u.Profile.Email, params["email"]) {
+				return usersLookupResponse{Ok: true, User: u}
+			}
+		}
+		return fail("users_not_found")
+	case "conversations.list":
+		channels := []channel{}
+		for _, c := range m.fixture.Channels {
+			if c.OrgWide || (c.IsArchived && params["exclude_archived"] == "true") {
+				continue
+			}
+			if c.IsPrivate && !strings.Contains(params["types"], "private_channel") {
+				continue
+			}
+			if !c.IsPrivate && !strings.Contains(params["types"], "public_channel") {
+				continue
+			}
+			info := c.channel
+			info.NumMembers = len(c.Members)
+			channels = append(channels, info)
+		}
+		return conversationsListResponse{Ok: true, Channels: channels, ResponseMetadata: noMore}
+	case "users.conversations":
+		channels := []channel{}
+		for _, c := range m.fixture.Channels {
+			if !c.IsArchived && slices.Contains(c.Members, params["user"]) {
+				channels = append(channels, c.channel)
+			}
+		}
+		return conversationsListResponse{Ok: true, Channels: channels, ResponseMetadata: noMore}
+	case "conversations.open":
+		return conversationsOpenResponse{Ok: true, Channel: channel{ID: "D0MOCK"}}
+	case "chat.postMessage", "conversations.setTopic", "conversations.setPurpose":
+		if params["channel"] != "D0MOCK" && m.channel(params["channel"]) == nil {
+			return fail("channel_not_found")
+		}
+		if method == "chat.postMessage" {
+			m.posted = append(m.posted, chatPostMessageRequest{ChannelID: params["channel"], Text: params["text"], ThreadTS: params["thread_ts"]})
+		}
+		return map[string]interface{}{"ok": true}
+	case "admin.conversations.search":
+		channels := []channel{}
+		for _, c := range m.fixture.Channels {
+			if strings.Contains(c.Name, params["query"]) {
+				channels = append(channels, c.channel)
+			}
+		}
+		return adminConversationsSearchResponse{Ok: true, Conversations: channels}
+	case "admin.conversations.invite":
+		c := m.channel(params["channel_id"])
+		if c == nil {
+			return fail("channel_not_found")
+		}
+		for _, userID := range strings.Split(params["user_ids"], ",") {
+			if m.user(userID) == nil {
+				return fail("user_not_found")
+			}
+			if !slices.Contains(c.Members, userID) {
+				c.Members = append(c.Members, userID)
+			}
+		}
+		return map[string]interface{}{"ok": true}
+	case "usergroups.list":
+		groups := []usergroup{}
+		for _, g := range m.fixture.Usergroups {
+			groups = append(groups, g.usergroup)
+		}
+		return usergroupsListResponse{Ok: true, Usergroups: groups}
+	case "usergroups.create":
+		g := mockUsergroup{usergroup: usergroup{ID: fmt.Sprintf("S0MOCK%d", len(m.fixture.Usergroups)+1), Handle: params["handle"], Name: params["name"]}, Users: []string{}}
+		m.fixture.Usergroups = append(m.fixture.Usergroups, g)
+		return usergroupResponse{Ok: true, Usergroup: g.usergroup}
+	case "usergroups.users.list", "usergroups.users.update":
+		g := m.usergroup(params["usergroup"])
+		if g == nil {
+			return fail("no_such_subteam")
+		}
+		if method == "usergroups.users.list" {
+			return usergroupsUsersListResponse{Ok: true, Users: g.Users}
+		}
+		// like Slack, bots and Slackbot can't be members of a user group
+		users := strings.Split(params["users"], ",")
+		for _, userID := range users {
+			if u := m.user(userID); u == nil || isBot(*u) {
+				return fail("invalid_users")
+			}
+		}
+		g.Users = users
+		return usergroupResponse{Ok: true, Usergroup: g.usergroup}
+	}
+
+	c := m.channel(params["channel"])
+	if c == nil || (c.OrgWide && method != "conversations.members") {
+		return fail("channel_not_found")
+	}
+	switch method {
+	case "conversations.info":
+		info := c.channel
+		info.NumMembers = len(c.Members)
+		return conversationsInfoResponse{Ok: true, Channel: info}
+	case "conversations.members":
+		return conversationsMembersResponse{Ok: true, Members: c.Members, ResponseMetadata: noMore}
+	case "reactions.get":
+		for _, msg := range c.Messages {
+			if msg.TS == params["timestamp"] {
+				return reactionsGetResponse{Ok: true, Message: msg}
+			}
+		}
+		return fail("message_not_found")
+	case "conversations.history", "conversations.replies":
+		// oldest and latest are inclusive, and all fixture timestamps have the same length so they compare as strings
+		messages := []message{}
+		for _, msg := range c.Messages {
+			if msg.TS < params["oldest"] || (params["latest"] != "" && msg.TS > params["latest"]) {
+				continue
+			}
+			inThread := msg.TS == params["ts"] || msg.ThreadTS == params["ts"]
+			topLevel := msg.ThreadTS == "" || msg.ThreadTS == msg.TS
+			if (method == "conversations.replies" && inThread) || (method == "conversations.history" && topLevel) {
+				messages = append(messages, msg)
+			}
+		}
+		if method == "conversations.replies" && len(messages) == 0 {
+			return fail("thread_not_found")
+		}
+		return conversationsMessagesResponse{Ok: true, Messages: messages, ResponseMetadata: noMore}
+	case "conversations.invite":
+		// like Slack, without force nobody is invited if anyone can't be
+		errs := []inviteUserError{}
+		invite := []string{}
+		for _, userID := range strings.Split(params["users"], ",") {
+			u := m.user(userID)
+			switch {
+			case u == nil:
+				errs = append(errs, inviteUserError{User: userID, Error: "user_not_found"})
+			case u.Deleted:
+				errs = append(errs, inviteUserError{User: userID, Error: "cant_invite"})
+			case slices.Contains(c.Members, userID):
+				errs = append(errs, inviteUserError{User: userID, Error: "already_in_channel"})
+			default:
+				invite = append(invite, userID)
+			}
+		}
+		if len(errs) > 0 && params["force"] != "true" {
+			return fail(errs[0].Error)
+		}
+		c.Members = append(c.Members, invite...)
+		if len(errs) > 0 {
+			return conversationsInviteResponse{Ok: false, Error: errs[0].Error, Errors: errs}
+		}
+		return conversationsInviteResponse{Ok: true}
+	case "conversations.kick":
+		if params["user"] == m.fixture.UserID {
+			return fail("cant_kick_self")
+		}
+		index := slices.Index(c.Members, params["user"])
+		if index < 0 {
+			return fail("not_in_channel")
+		}
+		c.Members = slices.Delete(c.Members, index, index+1)
+		return map[string]interface{}{"ok": true}
+	case "conversations.archive", "conversations.unarchive":
+		archive := method == "conversations.archive"
+		if c.IsArchived == archive {
+			if archive {
+				return fail("already_archived")
+			}
+			return fail("not_archived")
+		}
+		c.IsArchived = archive
+		return map[string]interface{}{"ok": true}
+	}
+	return fail("unknown_method")
+}
+
+func (m *mockSlack) user(userID string) *user {
+	for i := range m.fixture.Users {
+		if m.fixture.Users[i].ID == userID {
+			return &m.fixture.Users[i]
+		}
+	}
+	return nil
+}
+
+func (m *mockSlack) usergroup(usergroupID string) *mockUsergroup {
+	for i := range m.fixture.Usergroups {
+		if m.fixture.Usergroups[i].ID == usergroupID {
+			return &m.fixture.Usergroups[i]
+		}
+	}
+	return nil
+}
+
+func (m *mockSlack) channel(channelID string) *mockChannel {
+	for i := range m.fixture.Channels {
+		if m.fixture.Channels[i].ID == channelID {
+			return &m.fixture.Channels[i]
+		}
+	}
+	return nil
+}
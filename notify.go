@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// parseNotifiers creates a notifier for each comma separated sink spec.
+func parseNotifiers(specs, apiToken, smtpServer, smtpFrom string) ([]notifier, error) {
+	notifiers := []notifier{}
+	if specs == "" {
+		return notifiers, nil
+	}
+	for _, spec := range strings.Split(specs, ",") {
+		n, err := newNotifier(spec, apiToken, smtpServer, smtpFrom)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+func newNotifier(spec, apiToken, smtpServer, smtpFrom string) (notifier, error) {
+	kind, target, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "stdout":
+		return stdoutNotifier{}, nil
+	case "slack":
+		if target == "" {
+			return nil, fmt.Errorf("Notification sink '%s' needs a channel, e.g. 'slack:#ops'", spec)
+		}
+		return slackNotifier{apiToken: apiToken, channel: strings.TrimPrefix(target, "#")}, nil
+	case "webhook":
+		if !strings.HasPrefix(target, "https://") && !strings.HasPrefix(target, "http://") {
+			return nil, fmt.Errorf("Notification sink '%s' needs a URL, e.g. 'webhook:https://example.com/hook'", spec)
+		}
+		return webhookNotifier{url: target}, nil
+	case "email":
+		if target == "" || smtpServer == "" || smtpFrom == "" {
+			return nil, fmt.Errorf("Notification sink '%s' needs an address as well as -smtp_server and -smtp_from", spec)
+		}
+		return emailNotifier{server: smtpServer, from: smtpFrom, to: []string{target}}, nil
+	default:
+		return nil, fmt.Errorf("Unknown notification sink '%s'", spec)
+	}
+}
+
+// sendNotifications sends the run summary to every notifier. Failing to notify doesn't fail the run.
+func sendNotifications(notifiers []notifier, summary *runSummary) {
+	if len(notifiers) == 0 {
+		return
+	}
+
+	subject := fmt.Sprintf("slack-multi-channel-invite: '%s' finished with %d invited, %d removed, %d channels failed", summary.Action, summary.Invited, summary.Removed, summary.Failed)
+	sb := &strings.Builder{}
+	for _, result := range summary.Channels {
+		if result.Error != "" {
+			fmt.Fprintf(sb, "• %s: failed (%s)\n", result.Channel, result.Error)
+		} else {
+			fmt.Fprintf(sb, "• %s: %d invited, %d removed\n", result.Channel, result.Invited, result.Removed)
+		}
+	}
+
+	for _, n := range notifiers {
+		err := n.notify(subject, sb.String())
+		if err != nil {
+			logError("Error while sending notification: %s", err)
+		}
+	}
+}
+
+func (stdoutNotifier) notify(subject, body string) error {
+	fmt.Printf("\n%s\n%s", subject, body)
+	return nil
+}
+
+func (n slackNotifier) notify(subject, body string) error {
+	return postMessage(n.apiToken, n.channel, subject+"\n"+body)
+}
+
+func (n webhookNotifier) notify(subject, body string) error {
+	reqBody, err := json.Marshal(webhookPayload{Text: subject + "\n" + body})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := slackAPI.doExternal(requestCtx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n emailNotifier) notify(subject, body string) error {
+	host, _, err := net.SplitHostPort(n.server)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if password := os.Getenv(smtpPasswordEnvVar); password != "" {
+		auth = smtp.PlainAuth("", n.from, password, host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s", n.from, strings.Join(n.to, ", "), subject, body)
+	return smtp.SendMail(n.server, auth, n.from, n.to, []byte(msg))
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// add records the outcome of one operation. It is safe for concurrent use and does nothing on a nil report.
+func (r *operationReport) add(action, channel, user string, err error) {
+	entry := reportEntry{Time: time.Now().UTC(), Action: action, Channel: channel, User: user, Result: "ok"}
+	if err != nil {
+		entry.Result = "failed"
+		entry.Error = err.Error()
+	}
+	auditLog.record(entry)
+	metrics.add(metricSeries("slack_invite_operations_total", "action", action, "result", entry.Result), 1)
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Entries = append(r.Entries, entry)
+}
+
+// skip records an operation that wasn't needed, e.g. removing a user who isn't in the channel.
+func (r *operationReport) skip(action, channel, user, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Entries = append(r.Entries, reportEntry{Time: time.Now().UTC(), Action: action, Channel: channel, User: user, Result: "skipped", Error: reason})
+}
+
+// addInvites records inviting userIDs to a channel: a failed call fails all of them, otherwise only the
+// users Slack reported individually.
+func (r *operationReport) addInvites(channel string, userIDs []string, failed []inviteUserError, err error) {
+	for _, userID := range userIDs {
+		userErr := err
+		for _, userError := range failed {
+			if userError.User == userID {
+				userErr = errors.New(userError.Error)
+			}
+		}
+		r.add(actionAdd, channel, userID, userErr)
+	}
+}
+
+// openAuditLog prepares appending the changes of the run to the audit log at path, attributed to the local
+// account running the script and to the identity of the token, as reported by auth.test.
+func openAuditLog(path string, auth authTestResponse) (*auditLogger, error) {
+	operator := os.Getenv("USER")
+	if current, err := osuser.Current(); err == nil {
+		operator = current.Username
+	}
+
+	entries, err := readAuditLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lastHash := ""
+	if len(entries) > 0 {
+		lastHash = entries[len(entries)-1].Hash
+	}
+	return &auditLogger{
+		path: path,
+		identity: auditLogEntry{
+			Run:         time.Now().UTC().Format(time.RFC3339Nano),
+			Operator:    operator,
+			SlackUser:   auth.User,
+			SlackUserID: auth.UserID,
+			TeamID:      auth.TeamID,
+		},
+		lastHash: lastHash,
+	}, nil
+}
+
+// record appends an operation to the audit log; it does nothing on a nil log. The file is only ever
+// appended to, and synced after every entry.
+func (l *auditLogger) record(operation reportEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := l.identity
+	entry.Time, entry.Action, entry.Channel, entry.User = operation.Time, operation.Action, operation.Channel, operation.User
+	entry.Result, entry.Error = operation.Result, operation.Error
+	entry.PrevHash = l.lastHash
+	entry.Hash = auditLogHash(entry)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logWarn("Unable to write to the audit log: %s", err)
+		return
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logWarn("Unable to write to the audit log: %s", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		logWarn("Unable to write to the audit log: %s", err)
+		return
+	}
+	l.lastHash = entry.Hash
+}
+
+// auditLogHash returns the hash of an audit log entry: the SHA-256 of its previous hash and its JSON
+// encoding without Hash.
+func auditLogHash(entry auditLogEntry) string {
+	entry.Hash = ""
+	contents, _ := json.Marshal(entry)
+	sum := sha256.Sum256(append([]byte(entry.PrevHash+"\n"), contents...))
+	return hex.EncodeToString(sum[:])
+}
+
+// readAuditLog returns the entries of the audit log at path, oldest first.
+func readAuditLog(path string) ([]auditLogEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []auditLogEntry{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var entry auditLogEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid entry on line %d of %s: %s", line, path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// verifyAuditLog checks that every entry of the audit log at path is intact and chained to the one before,
+// and returns how many entries there are.
+func verifyAuditLog(path string) (int, error) {
+	entries, err := readAuditLog(path)
+	if err != nil {
+		return 0, err
+	}
+	prevHash := ""
+	for i, entry := range entries {
+		if entry.PrevHash != prevHash {
+			return i, fmt.Errorf("Entry on line %d doesn't follow the one before: entries were removed or reordered", i+1)
+		}
+		if auditLogHash(entry) != entry.Hash {
+			return i, fmt.Errorf("Entry on line %d doesn't match its hash: it was modified", i+1)
+		}
+		prevHash = entry.Hash
+	}
+	return len(entries), nil
+}
+
+// record appends the users a run successfully invited to (actionAdd) or removed from (actionRemove) a channel
+// to the journal; it does nothing on a nil journal. The journal is appended to right away, so it's complete
+// even if the run is interrupted.
+func (j *runJournal) record(action, channelID, channelName string, userIDs ...string) {
+	if j == nil || len(userIDs) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logWarn("Unable to write to the journal: %s", err)
+		return
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	for _, userID := range userIDs {
+		err = encoder.Encode(journalEntry{Run: j.run, Time: time.Now().UTC(), Action: action, ChannelID: channelID, Channel: channelName, User: userID, Undoes: j.undoes})
+		if err != nil {
+			logWarn("Unable to write to the journal: %s", err)
+			return
+		}
+	}
+}
+
+// readJournal returns the entries of the journal at path, oldest first.
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []journalEntry{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry journalEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid entry on line %d of %s: %s", line, path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// lastUndoableRun returns the ID and the changes of the most recent run of the journal, other than the 'undo'
+// runs and the runs they already reversed.
+func lastUndoableRun(entries []journalEntry) (string, []journalEntry) {
+	undone := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Undoes != "" {
+			undone[entry.Undoes] = true
+		}
+	}
+	run := ""
+	for i := len(entries) - 1; i >= 0 && run == ""; i-- {
+		if entries[i].Undoes == "" && !undone[entries[i].Run] {
+			run = entries[i].Run
+		}
+	}
+	changes := []journalEntry{}
+	for _, entry := range entries {
+		if entry.Run == run {
+			changes = append(changes, entry)
+		}
+	}
+	return run, changes
+}
+
+// undoLastRun reverses the most recent run of the journal that wasn't undone yet: the users it invited are
+// removed and the users it removed are invited back. Runs that ended more than window ago are left alone.
+// The undo is recorded in the journal as well, so running it again undoes the run before.
+func undoLastRun(apiToken, journalPath string, window time.Duration, ask, dryRun, debug bool, summary *runSummary) error {
+	entries, err := readJournal(journalPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Nothing to undo, %s doesn't exist yet", journalPath)
+	} else if err != nil {
+		return err
+	}
+	run, changes := lastUndoableRun(entries)
+	if run == "" {
+		return fmt.Errorf("Nothing to undo in %s", journalPath)
+	}
+	if age := time.Since(changes[len(changes)-1].Time); age > window {
+		return fmt.Errorf("The last run (%s) ended %s ago, more than -undo_window", run, age.Round(time.Minute))
+	}
+
+	// a user invited and then removed again by the same run (or the other way around) is left as is
+	toRemove, toInvite := map[string][]string{}, map[string][]string{}
+	names := map[string]string{}
+	for _, change := range changes {
+		names[change.ChannelID] = change.Channel
+		switch change.Action {
+		case actionAdd:
+			if i := slices.Index(toInvite[change.ChannelID], change.User); i >= 0 {
+				toInvite[change.ChannelID] = slices.Delete(toInvite[change.ChannelID], i, i+1)
+			} else {
+				toRemove[change.ChannelID] = append(toRemove[change.ChannelID], change.User)
+			}
+		case actionRemove:
+			if i := slices.Index(toRemove[change.ChannelID], change.User); i >= 0 {
+				toRemove[change.ChannelID] = slices.Delete(toRemove[change.ChannelID], i, i+1)
+			} else {
+				toInvite[change.ChannelID] = append(toInvite[change.ChannelID], change.User)
+			}
+		}
+	}
+	channelIDs := maps.Keys(names)
+	sort.Slice(channelIDs, func(i, j int) bool { return names[channelIDs[i]] < names[channelIDs[j]] })
+
+	prefix := ""
+	if dryRun {
+		prefix = "[dry run] "
+	}
+	fmt.Printf("%sUndoing the run of %s:\n", prefix, run)
+	for _, channelID := range channelIDs {
+		fmt.Printf("\t • '%s': remove %d users, invite back %d users\n", names[channelID], len(toRemove[channelID]), len(toInvite[channelID]))
+	}
+	if dryRun {
+		return nil
+	}
+	if ask && !confirm(fmt.Sprintf("Undo the run of %s?", run)) {
+		logInfo("Nothing undone")
+		return nil
+	}
+
+	if journal != nil {
+		journal.undoes = run
+	}
+	for _, channelID := range channelIDs {
+		if stopping(summary) {
+			break
+		}
+		channelName := names[channelID]
+		result := channelResult{Channel: channelName}
+		var removed, invited []string
+		var err error
+		if len(toRemove[channelID]) > 0 {
+			removed, err = removeUsersFromChannel(apiToken, toRemove[channelID], channelID, channelName, debug)
+		}
+		if err == nil && len(toInvite[channelID]) > 0 {
+			invited, result.FailedUsers, err = inviteUsersInBatches(apiToken, toInvite[channelID], channelID, channelName, maxInviteBatchSize, false)
+		}
+		result.Removed, result.Invited = len(removed), len(invited)
+		if err != nil {
+			reportError("Error while undoing the changes to %s (%s): %s", channelName, channelID, err)
+			result.Error = err.Error()
+		}
+		summary.record(result)
+	}
+	return nil
+}
+
+// save writes the report to its path; it does nothing on a nil report.
+func (r *operationReport) save() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, contents, 0644)
+}
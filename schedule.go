@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// cronSchedule is a parsed -schedule: the minutes, hours, days of the month, months and days of the week
+// (0 is Sunday) it matches, as bit sets.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// when both the day of the month and the day of the week are restricted, a day matching either one
+	// matches, as in cron
+	anyDay, anyWeekday bool
+}
+
+// cronFields are the names and bounds of the five fields of a cron expression.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7}}
+
+// parseCronSchedule parses a standard five field cron expression such as '0 7 * * 1-5' or '*/30 9-17 * * *'.
+// Fields hold '*', numbers, ranges and steps, separated by commas. Names like 'mon' aren't supported.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("Invalid -schedule '%s', expected 5 fields: minute, hour, day of month, month and day of week", spec)
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		bounds := cronFields[i]
+		for _, part := range strings.Split(field, ",") {
+			invalid := fmt.Errorf("Invalid -schedule '%s', bad %s '%s'", spec, bounds.name, part)
+			values, stepValue, hasStep := strings.Cut(part, "/")
+			step := 1
+			if hasStep {
+				var err error
+				step, err = strconv.Atoi(stepValue)
+				if err != nil || step < 1 {
+					return nil, invalid
+				}
+			}
+
+			low, high := bounds.min, bounds.max
+			if values != "*" {
+				from, to, isRange := strings.Cut(values, "-")
+				var err error
+				low, err = strconv.Atoi(from)
+				if err != nil {
+					return nil, invalid
+				}
+				high = low
+				if isRange {
+					high, err = strconv.Atoi(to)
+					if err != nil {
+						return nil, invalid
+					}
+				} else if hasStep {
+					// '5/15' means from 5 to the end, every 15
+					high = bounds.max
+				}
+				if low < bounds.min || high > bounds.max || low > high {
+					return nil, invalid
+				}
+			}
+			for value := low; value <= high; value += step {
+				sets[i] |= 1 << uint(value)
+			}
+		}
+	}
+	// 7 is Sunday too
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &cronSchedule{
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		weekdays:   sets[4],
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// next returns the first minute after t matching the schedule, in t's location, or the zero time if there's
+// none within five years (e.g. for February 30th).
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		} else if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		} else if c.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		} else if c.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	day := c.days&(1<<uint(t.Day())) != 0
+	weekday := c.weekdays&(1<<uint(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// runScheduled runs the script again with args, minus -schedule, at every time matching the schedule until
+// Ctrl-C. Each run writes its own -summary_file and -report, suffixed with the time it was scheduled for.
+// A time that comes up while the previous run is still going is skipped.
+func runScheduled(schedule *cronSchedule, args []string, summaryFile, reportFile string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for {
+		start := schedule.next(time.Now())
+		if start.IsZero() {
+			return fmt.Errorf("-schedule never matches")
+		}
+		logInfo("Next run at %s", start.Format(time.RFC3339))
+		if !sleepUntilDone(ctx, time.Until(start)) {
+			logInfo("Stopped the schedule")
+			return nil
+		}
+
+		err := rerun(args, start, summaryFile, reportFile)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// runWatched runs the script again with args, minus -watch, right away and then whenever the file at path
+// changes, until Ctrl-C. A run only starts once the file has stayed unchanged for settle, so a file still
+// being written isn't read halfway. The file's directory is watched rather than the file itself, so a writer
+// that renames a temporary file over it is followed too. Each run writes its own -summary_file and -report,
+// suffixed with the time it started.
+func runWatched(path string, settle time.Duration, args []string, summaryFile, reportFile string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Clean(path)
+	settled := time.NewTimer(settle)
+	defer settled.Stop()
+	first := true
+	for {
+		select {
+		case <-ctx.Done():
+			logInfo("Stopped watching %s", path)
+			return nil
+		case err := <-watcher.Errors:
+			// e.g. an overflow of the event queue, after which changes may have been missed
+			logWarn("Error while watching %s: %s", path, err)
+			settled.Reset(settle)
+		case event := <-watcher.Events:
+			if filepath.Clean(event.Name) != name || event.Op == fsnotify.Chmod {
+				continue
+			}
+			// wait for the writer to be done
+			if !settled.Stop() {
+				select {
+				case <-settled.C:
+				default:
+				}
+			}
+			settled.Reset(settle)
+		case <-settled.C:
+			if _, err := os.Stat(path); err != nil {
+				// a writer replacing the file may leave none behind for a moment
+				logDebug("%s isn't there (%s), waiting for it", path, err)
+				continue
+			}
+			if !first {
+				logInfo("%s changed", path)
+			}
+			first = false
+			err := rerun(args, time.Now(), summaryFile, reportFile)
+			if err != nil {
+				return err
+			}
+			logInfo("Watching %s for changes", path)
+		}
+	}
+}
+
+// sleepUntilDone waits for d and returns true, or returns false as soon as ctx is done.
+func sleepUntilDone(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// rerun runs the script with rerunArgs and waits for it, see runChild.
+func rerun(args []string, start time.Time, summaryFile, reportFile string) error {
+	return runChild(start.Format(time.RFC3339), rerunArgs(args, start, summaryFile, reportFile))
+}
+
+// runForTeams runs the script with args once for every workspace of the Enterprise Grid org, with -team_id
+// set to it and -summary_file and -report (when set) suffixed with its ID. The workspaces are done one after
+// the other, each in its own process.
+func runForTeams(apiToken string, args []string, summaryFile, reportFile string) error {
+	teams, err := listOrgTeams(apiToken)
+	if err != nil {
+		return fmt.Errorf("Error while listing the workspaces of the org: %s", err)
+	}
+	logInfo("Running for %d workspaces", len(teams))
+	for _, t := range teams {
+		var overrides []string
+		overrides = append(overrides, "-team_id="+t.ID)
+		if summaryFile != "" {
+			overrides = append(overrides, "-summary_file="+suffixedPath(summaryFile, t.ID))
+		}
+		if reportFile != "" {
+			overrides = append(overrides, "-report="+suffixedPath(reportFile, t.ID))
+		}
+		args := childArgs(args, map[string]bool{"all_teams": false, "team_id": true, "summary_file": true, "report": true}, overrides)
+		err := runChild(fmt.Sprintf("%s (%s)", t.Name, t.ID), args)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runChild runs the script with args and waits for it, logging how the run named name went. Only failing to
+// start it is an error: a run that fails is reported and the next one happens as planned.
+func runChild(name string, args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Unable to find the script's executable: %s", err)
+	}
+	// the run hands its metrics over in a file of its own
+	handover, err := os.CreateTemp("", "slack-multi-invite-metrics-*.json")
+	if err != nil {
+		return fmt.Errorf("Unable to create the metrics file of the run: %s", err)
+	}
+	handover.Close()
+	defer os.Remove(handover.Name())
+
+	// the run gets Ctrl-C too, and stops on its own
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(os.Environ(), metricsFileEnvVar+"="+handover.Name())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	code := exitOK
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		return fmt.Errorf("Unable to start the run of %s: %s", name, err)
+	}
+
+	var run metricsRegistry
+	contents, err := os.ReadFile(handover.Name())
+	if err == nil && len(contents) > 0 && json.Unmarshal(contents, &run) == nil {
+		metrics.merge(&run)
+	}
+	result := "ok"
+	switch code {
+	case exitOK:
+		logInfo("Run of %s done", name)
+	case exitDrift:
+		result = "drift"
+		logWarn("Run of %s found users missing from channels", name)
+	default:
+		result = "failed"
+		logError("Run of %s failed with exit code %d", name, code)
+	}
+	metrics.add(metricSeries("slack_invite_runs_total", "result", result), 1)
+	return nil
+}
+
+// rerunArgs returns the arguments of the run starting at start: args without -schedule and -watch, and with
+// -summary_file and -report (when set) suffixed with the start time.
+func rerunArgs(args []string, start time.Time, summaryFile, reportFile string) []string {
+	var overrides []string
+	if summaryFile != "" {
+		overrides = append(overrides, "-summary_file="+timestampedPath(summaryFile, start))
+	}
+	if reportFile != "" {
+		overrides = append(overrides, "-report="+timestampedPath(reportFile, start))
+	}
+	return childArgs(args, map[string]bool{"watch": false, "schedule": true, "summary_file": true, "report": true}, overrides)
+}
+
+// childArgs returns args without the dropped flags, which map to whether they take a value, and with the
+// overrides added after the subcommand (if any).
+func childArgs(args []string, dropped map[string]bool, overrides []string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			kept = append(kept, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(args[i], "-") {
+			kept = append(kept, args[i])
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		takesValue, drop := dropped[name]
+		if !drop {
+			kept = append(kept, args[i])
+		} else if takesValue && !hasValue {
+			i++
+		}
+	}
+
+	// flags come after the subcommand
+	if _, ok := findSubcommand(kept); ok {
+		return append(append([]string{kept[0]}, overrides...), kept[1:]...)
+	}
+	return append(overrides, kept...)
+}
+
+// timestampedPath inserts t before the extension of path, e.g. 'summary-20240130T0700.json'.
+func timestampedPath(path string, t time.Time) string {
+	return suffixedPath(path, t.Format("20060102T1504"))
+}
+
+// suffixedPath returns path with suffix added before its extension, e.g. summary-T0123.json.
+func suffixedPath(path, suffix string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + suffix + ext
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// serve runs the HTTP API on the address until the run is interrupted.
+func (s *apiServer) serve(addr string) error {
+	server := &http.Server{Addr: addr, Handler: s.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-requestCtx.Done()
+		server.Shutdown(context.Background())
+	}()
+	logInfo("Serving the HTTP API on %s", addr)
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	if s.authToken != "" {
+		mux.HandleFunc("/invite", s.authenticated(http.MethodPost, s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+			s.change(w, r, actionAdd)
+		})))
+		mux.HandleFunc("/remove", s.authenticated(http.MethodPost, s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+			s.change(w, r, actionRemove)
+		})))
+		mux.HandleFunc("/channels", s.authenticated(http.MethodGet, s.channels))
+		mux.HandleFunc("/audit", s.authenticated(http.MethodGet, s.audit))
+	}
+	if s.signingSecret != "" {
+		mux.HandleFunc("/slack/commands", s.slashCommand)
+		mux.HandleFunc("/slack/events", s.events)
+	}
+	return mux
+}
+
+// authenticated only passes requests with the method and the server's bearer token on to the handler.
+func (s *apiServer) authenticated(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.authToken)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		if r.Method != method {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s %s isn't supported", r.Method, r.URL.Path))
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		logInfo("%s %s", r.Method, r.URL.Path)
+		handler(w, r)
+	}
+}
+
+// idempotent answers a request with the same Idempotency-Key header as an earlier one with the response to
+// that request instead of running it again, so clients can safely retry a mutation that timed out. A key
+// reused with another body is refused, and requests without the header always run.
+func (s *apiServer) idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unable to read request body: %s", err))
+			return
+		}
+		hash := sha256.Sum256(body)
+
+		key = r.URL.Path + " " + key
+		if stored, ok := s.responses.lookup(key); ok {
+			if stored.requestHash != hash {
+				writeJSONError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for another request")
+				return
+			}
+			logInfo("Answering %s with the response to the earlier request with the same Idempotency-Key", r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			w.Write(stored.body)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		recorder := httptest.NewRecorder()
+		handler(recorder, r)
+		// a request that failed on the server's side may not have run, so its retry runs again
+		if recorder.Code < http.StatusInternalServerError {
+			s.responses.store(key, idempotentResponse{requestHash: hash, status: recorder.Code, body: recorder.Body.Bytes()})
+		}
+		for name, values := range recorder.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}
+}
+
+func (d *idempotencyStore) lookup(key string) (idempotentResponse, bool) {
+	response, ok := d.responses[key]
+	return response, ok
+}
+
+// store keeps the response to the key, dropping the oldest key once there are maxIdempotencyKeys.
+func (d *idempotencyStore) store(key string, response idempotentResponse) {
+	if d.responses == nil {
+		d.responses = map[string]idempotentResponse{}
+	}
+	if len(d.keys) >= maxIdempotencyKeys {
+		delete(d.responses, d.keys[0])
+		d.keys = d.keys[1:]
+	}
+	d.responses[key] = response
+	d.keys = append(d.keys, key)
+}
+
+// change invites or removes the users of a serveRequest to or from its channels.
+func (s *apiServer) change(w http.ResponseWriter, r *http.Request, action string) {
+	var body serveRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+		return
+	}
+	if len(body.Emails) == 0 || len(body.Channels) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "'emails' and 'channels' are required")
+		return
+	}
+
+	channelNameToIDMap, err := getChannelsCached(s.slackToken, s.private, false, false, s.opts.debug, s.channelCachePath, s.channelCacheTTL, body.Channels)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("unable to list channels: %s", err))
+		return
+	}
+	userIDs, notFound := getUsersIdsFrom(s.slackToken, strings.Join(body.Emails, ","), s.merge)
+	summary := &runSummary{Action: action}
+	if len(userIDs) > 0 {
+		opts := s.opts
+		opts.dryRun = opts.dryRun || body.DryRun
+		channels := expandChannelPatterns(body.Channels, channelNameToIDMap)
+		applyToChannels(s.slackToken, action, userIDs, channels, channelNameToIDMap, opts, summary)
+	}
+	if err := operations.save(); err != nil {
+		logWarn("Unable to write report: %s", err)
+	}
+	writeJSON(w, http.StatusOK, serveChangeResponse{Summary: summary, NotFound: notFound})
+}
+
+// channels lists the channels the token can see.
+func (s *apiServer) channels(w http.ResponseWriter, r *http.Request) {
+	channelNameToIDMap, err := getChannelsCached(s.slackToken, s.private, false, false, s.opts.debug, s.channelCachePath, s.channelCacheTTL, nil)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("unable to list channels: %s", err))
+		return
+	}
+	type channelEntry struct {
+		Name string `json:"name"`
+		ID   string `json:"id"`
+	}
+	names := maps.Keys(channelNameToIDMap)
+	slices.Sort(names)
+	channels := []channelEntry{}
+	for _, name := range names {
+		channels = append(channels, channelEntry{Name: name, ID: channelNameToIDMap[name]})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"channels": channels})
+}
+
+// audit reports which of the comma separated emails are missing from which of the comma separated channels.
+func (s *apiServer) audit(w http.ResponseWriter, r *http.Request) {
+	emails, channelsArg := r.URL.Query().Get("emails"), r.URL.Query().Get("channels")
+	if emails == "" || channelsArg == "" {
+		writeJSONError(w, http.StatusBadRequest, "'emails' and 'channels' are required")
+		return
+	}
+
+	channelNameToIDMap, err := getChannelsCached(s.slackToken, s.private, false, false, s.opts.debug, s.channelCachePath, s.channelCacheTTL, strings.Split(channelsArg, ","))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("unable to list channels: %s", err))
+		return
+	}
+	userIDs, _ := getUsersIdsFrom(s.slackToken, emails, s.merge)
+	channels := expandChannelPatterns(strings.Split(channelsArg, ","), channelNameToIDMap)
+	missing, err := findMissingMembers(s.slackToken, userIDs, channels, channelNameToIDMap, s.parallel, s.opts.debug)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	response := serveAuditResponse{Missing: missing}
+	for _, channel := range channels {
+		if channelNameToIDMap[channel] == "" {
+			response.ChannelsNotFound = append(response.ChannelsNotFound, channel)
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// slashCommand handles the /bulk-invite slash command, e.g. '/bulk-invite #dubnation steph@warriors.com,@oncall'.
+// Slack only waits 3 seconds for an answer, so the invites happen afterwards and their outcome is posted to
+// the command's response_url.
+func (s *apiServer) slashCommand(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.readSignedRequest(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	channels, entries := parseSlashCommandText(form.Get("text"))
+	if len(channels) == 0 || len(entries) == 0 {
+		writeJSON(w, http.StatusOK, slashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("Usage: %s #channel email@example.com,@usergroup ...", form.Get("command"))})
+		return
+	}
+	logInfo("%s %s (from %s)", form.Get("command"), form.Get("text"), form.Get("user_id"))
+	writeJSON(w, http.StatusOK, slashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("Inviting %s to #%s ...", strings.Join(entries, ", "), strings.Join(channels, ", #"))})
+
+	go s.answerSlashCommand(form.Get("command"), form.Get("user_id"), form.Get("response_url"), channels, entries)
+}
+
+// events handles the requests of the Events API: the URL verification when the request URL is set up in the
+// app, and then the events themselves, answered right away and handled in the background.
+func (s *apiServer) events(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.readSignedRequest(w, r)
+	if !ok {
+		return
+	}
+	var callback eventCallback
+	err := json.Unmarshal(body, &callback)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	switch callback.Type {
+	case "url_verification":
+		writeJSON(w, http.StatusOK, map[string]string{"challenge": callback.Challenge})
+	case "event_callback":
+		w.WriteHeader(http.StatusOK)
+		go s.handleEvent(callback.Event)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// readSignedRequest returns the body of a POST request signed with the server's signing secret. Otherwise it
+// answers the request with an error and returns false.
+func (s *apiServer) readSignedRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("%s %s isn't supported", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "unable to read the request", http.StatusBadRequest)
+		return nil, false
+	}
+	err = verifySlackSignature(s.signingSecret, r.Header, body, time.Now())
+	if err != nil {
+		logWarn("Rejected a request to %s: %s", r.URL.Path, err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// answerSlashCommand runs a /bulk-invite command for the user with ID userID and posts the outcome to the
+// command's responseURL.
+func (s *apiServer) answerSlashCommand(command, userID, responseURL string, channels, entries []string) {
+	s.mu.Lock()
+	text := s.bulkInvite(userID, channels, entries)
+	s.mu.Unlock()
+	err := postSlashCommandResponse(responseURL, text)
+	if err != nil {
+		logError("Unable to answer %s: %s", command, err)
+	}
+}
+
+// run serves the HTTP endpoints on addr and connects in Socket Mode, each only if the server has the tokens
+// for it, until requestCtx is cancelled or one of them fails.
+func (s *apiServer) run(addr string) error {
+	errs := make(chan error, 2)
+	if s.appToken != "" {
+		go func() { errs <- s.socketMode() }()
+	}
+	if s.authToken != "" || s.signingSecret != "" {
+		go func() { errs <- s.serve(addr) }()
+	}
+	return <-errs
+}
+
+// socketMode connects to Slack in Socket Mode, so the server gets events and slash commands without a public
+// HTTP endpoint, and handles them until requestCtx is cancelled. It reconnects whenever Slack asks to or the
+// connection drops, backing off while connecting fails. Connections go straight to Slack, not through -proxy.
+func (s *apiServer) socketMode() error {
+	attempt := 0
+	for requestCtx.Err() == nil {
+		ws, err := s.connectSocketMode()
+		if err != nil {
+			if requestCtx.Err() != nil {
+				break
+			}
+			delay := backoffDelay(attempt, 0)
+			attempt++
+			logWarn("Unable to connect in Socket Mode (%s), retrying in %s", err, delay.Round(time.Millisecond))
+			sleep(delay)
+			continue
+		}
+		attempt = 0
+		logInfo("Connected to Slack in Socket Mode")
+
+		closed := make(chan struct{})
+		go func() {
+			select {
+			case <-requestCtx.Done():
+				ws.Close()
+			case <-closed:
+			}
+		}()
+		err = s.handleSocketMode(ws)
+		close(closed)
+		ws.Close()
+		if err != nil && requestCtx.Err() == nil {
+			logWarn("Socket Mode connection lost (%s), reconnecting", err)
+			sleep(time.Second)
+		}
+	}
+	return nil
+}
+
+// connectSocketMode opens a new Socket Mode connection.
+func (s *apiServer) connectSocketMode() (*websocket.Conn, error) {
+	wsURL, err := openSocketModeURL(s.appToken)
+	if err != nil {
+		return nil, err
+	}
+	return dialWebSocket(wsURL)
+}
+
+// handleSocketMode acknowledges and handles the messages of a Socket Mode connection until Slack asks to
+// reconnect or the connection closes. Handlers run in the background so pings keep being answered, but are
+// waited for before returning. A connection that stays silent for socketModeTimeout, despite being pinged, is
+// taken for dead.
+func (s *apiServer) handleSocketMode(ws *websocket.Conn) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timeout := socketModeTimeout
+	alive := func() { ws.SetReadDeadline(time.Now().Add(timeout)) }
+	alive()
+	ws.SetPingHandler(func(data string) error {
+		alive()
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(timeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	ws.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+	stopPings := make(chan struct{})
+	defer close(stopPings)
+	go func() {
+		ticker := time.NewTicker(timeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopPings:
+				return
+			case <-ticker.C:
+				ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+			}
+		}
+	}()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		alive()
+		var envelope socketModeEnvelope
+		err = json.Unmarshal(data, &envelope)
+		if err != nil {
+			logWarn("Ignoring an invalid Socket Mode message: %s", err)
+			continue
+		}
+		// Slack sends envelopes again when they aren't acknowledged within 3 seconds
+		if envelope.EnvelopeID != "" {
+			ack, _ := json.Marshal(map[string]string{"envelope_id": envelope.EnvelopeID})
+			err = ws.WriteMessage(websocket.TextMessage, ack)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch envelope.Type {
+		case "hello":
+			logDebug("Socket Mode connection ready")
+		case "disconnect":
+			logDebug("Slack asked to reconnect (%s)", envelope.Reason)
+			return nil
+		case "events_api":
+			var payload socketModeEventsPayload
+			if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+				logWarn("Ignoring an invalid event: %s", err)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handleEvent(payload.Event)
+			}()
+		case "slash_commands":
+			var command socketModeCommandPayload
+			if err := json.Unmarshal(envelope.Payload, &command); err != nil {
+				logWarn("Ignoring an invalid slash command: %s", err)
+				continue
+			}
+			logInfo("%s %s (from %s)", command.Command, command.Text, command.UserID)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				channels, entries := parseSlashCommandText(command.Text)
+				if len(channels) == 0 || len(entries) == 0 {
+					postSlashCommandResponse(command.ResponseURL, fmt.Sprintf("Usage: %s #channel email@example.com,@usergroup ...", command.Command))
+					return
+				}
+				s.answerSlashCommand(command.Command, command.UserID, command.ResponseURL, channels, entries)
+			}()
+		}
+	}
+}
+
+// handleEvent handles an event delivered over Socket Mode or the Events API: direct messages to the bot are
+// read like the text of a /bulk-invite command and answered in a thread, and new members of the workspace
+// are invited to their -join_channels.
+func (s *apiServer) handleEvent(event slackEvent) {
+	switch event.Type {
+	case "message":
+		var userID string
+		json.Unmarshal(event.User, &userID)
+		if event.ChannelType != "im" || event.Subtype != "" || event.BotID != "" || userID == "" {
+			return
+		}
+		text := "Send me the channels and the people to invite to them, e.g. `#dubnation steph@warriors.com,@oncall`"
+		channels, entries := parseSlashCommandText(event.Text)
+		if len(channels) > 0 && len(entries) > 0 {
+			logInfo("Direct message from %s: %s", userID, event.Text)
+			s.mu.Lock()
+			text = s.bulkInvite(userID, channels, entries)
+			s.mu.Unlock()
+		}
+		err := postMessageInThread(s.botToken, event.Channel, event.TS, text)
+		if err != nil {
+			logError("Unable to answer the direct message from %s: %s", userID, err)
+		}
+	case "team_join":
+		var u user
+		err := json.Unmarshal(event.User, &u)
+		if err != nil {
+			logWarn("Ignoring a team_join event with an invalid user: %s", err)
+			return
+		}
+		s.mu.Lock()
+		s.welcome(u)
+		s.mu.Unlock()
+	}
+}
+
+// welcome invites a new member of the workspace to the -join_channels for everyone and for their email
+// domain. Bots and guests are left alone, guests only get to see the channels they were invited to.
+func (s *apiServer) welcome(u user) {
+	if u.IsBot || u.Deleted || u.IsRestricted || u.IsUltraRestricted {
+		return
+	}
+	_, domain, _ := strings.Cut(strings.ToLower(u.Profile.Email), "@")
+	channels := append(slices.Clone(s.joinChannels["*"]), s.joinChannels[domain]...)
+	if len(channels) == 0 {
+		logDebug("No -join_channels for %s (%s)", u.ID, u.Profile.Email)
+		return
+	}
+
+	logInfo("%s (%s) joined the workspace, inviting them to %s", u.ID, u.Profile.Email, strings.Join(channels, ", "))
+	channelNameToIDMap, err := getChannelsCached(s.slackToken, s.private, false, false, s.opts.debug, s.channelCachePath, s.channelCacheTTL, channels)
+	if err != nil {
+		logError("Unable to list channels: %s", err)
+		return
+	}
+	summary := &runSummary{Action: actionAdd}
+	applyToChannels(s.slackToken, actionAdd, []string{u.ID}, expandChannelPatterns(channels, channelNameToIDMap), channelNameToIDMap, s.opts, summary)
+	if err := operations.save(); err != nil {
+		logWarn("Unable to write report: %s", err)
+	}
+}
+
+// parseJoinChannels parses -join_channels: entries separated by ';', each a comma separated list of channels
+// for everyone or, prefixed with 'domain=', for the members with that email domain.
+func parseJoinChannels(value string) (map[string][]string, error) {
+	joinChannels := map[string][]string{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		domain, channels, hasDomain := strings.Cut(entry, "=")
+		if !hasDomain {
+			domain, channels = "*", entry
+		}
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain == "" || channels == "" {
+			return nil, fmt.Errorf("Invalid -join_channels entry '%s', expected 'channel,...' or 'domain=channel,...'", entry)
+		}
+		for _, channel := range strings.Split(channels, ",") {
+			if channel = strings.TrimPrefix(strings.TrimSpace(channel), "#"); channel != "" {
+				joinChannels[domain] = append(joinChannels[domain], channel)
+			}
+		}
+	}
+	return joinChannels, nil
+}
+
+// openSocketModeURL returns the WebSocket URL of a new Socket Mode connection.
+func openSocketModeURL(appToken string) (string, error) {
+	var data appsConnectionsOpenResponse
+	err := slackPost(appToken, appsConnectionsOpenURL, nil, "opening a Socket Mode connection", &data)
+	if err != nil {
+		return "", err
+	}
+
+	return data.URL, nil
+}
+
+// dialWebSocket opens a client WebSocket connection to a wss:// URL.
+func dialWebSocket(rawURL string) (*websocket.Conn, error) {
+	if !strings.HasPrefix(rawURL, "wss://") {
+		return nil, fmt.Errorf("Unsupported WebSocket URL '%s', expected 'wss://'", rawURL)
+	}
+	// the TLS settings of -ca_bundle and -tls_min_version apply here too
+	dialer := &websocket.Dialer{HandshakeTimeout: 30 * time.Second}
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		dialer.TLSClientConfig = transport.TLSClientConfig.Clone()
+	}
+	ws, resp, err := dialer.DialContext(requestCtx, rawURL, nil)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		return nil, fmt.Errorf("WebSocket handshake failed with status code %d", resp.StatusCode)
+	} else if err != nil {
+		return nil, err
+	}
+	ws.SetReadLimit(maxWebSocketMessage)
+	return ws, nil
+}
+
+// bulkInvite invites the users of entries to the channels on behalf of the user with ID userID, who has to be
+// a member of them, and returns the outcome as a message for that user.
+func (s *apiServer) bulkInvite(userID string, channels, entries []string) string {
+	channelNameToIDMap, err := getChannelsCached(s.slackToken, s.private, false, false, s.opts.debug, s.channelCachePath, s.channelCacheTTL, channels)
+	if err != nil {
+		return fmt.Sprintf("Unable to list channels: %s", err)
+	}
+	// channels picked from the autocomplete may only come with their ID
+	for i, channel := range channels {
+		for name, channelID := range channelNameToIDMap {
+			if channelID == channel {
+				channels[i] = name
+			}
+		}
+	}
+	members, err := fetchChannelMembers(s.slackToken, channels, channelNameToIDMap, s.parallel, s.opts.debug)
+	if err != nil {
+		return fmt.Sprintf("Unable to list the members of the channels: %s", err)
+	}
+
+	var allowed, problems []string
+	for _, channel := range channels {
+		if channelNameToIDMap[channel] == "" {
+			problems = append(problems, fmt.Sprintf("#%s doesn't exist", channel))
+		} else if !slices.Contains(members[channel], userID) {
+			problems = append(problems, fmt.Sprintf("You need to be a member of #%s to invite people to it", channel))
+		} else {
+			allowed = append(allowed, channel)
+		}
+	}
+	if len(allowed) == 0 {
+		return strings.Join(problems, "\n")
+	}
+
+	userIDs, notFound := getUsersIdsFrom(s.slackToken, strings.Join(entries, ","), s.merge)
+	summary := &runSummary{Action: actionAdd}
+	if len(userIDs) > 0 {
+		applyToChannels(s.slackToken, actionAdd, userIDs, allowed, channelNameToIDMap, s.opts, summary)
+	}
+	if err := operations.save(); err != nil {
+		logWarn("Unable to write report: %s", err)
+	}
+	lines := []string{fmt.Sprintf("Invited %d users to #%s (%d channels failed)", summary.Invited, strings.Join(allowed, ", #"), summary.Failed)}
+	if len(notFound) > 0 {
+		lines = append(lines, "Not found: "+strings.Join(notFound, ", "))
+	}
+	return strings.Join(append(lines, problems...), "\n")
+}
+
+// parseSlashCommandText splits the text of a /bulk-invite command into channels and user entries. Channels
+// start with '#', or are mentions like '<#C0DUB|dubnation>' when Slack escapes them; entries are separated by
+// commas or spaces, with Slack's formatting of emails and user group mentions undone.
+func parseSlashCommandText(text string) (channels, entries []string) {
+	tokens := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' })
+	for _, token := range tokens {
+		switch {
+		case strings.HasPrefix(token, "<#") && strings.HasSuffix(token, ">"):
+			channelID, name, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(token, "<#"), ">"), "|")
+			if name == "" {
+				name = channelID
+			}
+			channels = append(channels, name)
+		case strings.HasPrefix(token, "#"):
+			channels = append(channels, strings.TrimPrefix(token, "#"))
+		case strings.HasPrefix(token, "<mailto:") && strings.HasSuffix(token, ">"):
+			email, _, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(token, "<mailto:"), ">"), "|")
+			entries = append(entries, email)
+		case strings.HasPrefix(token, "<!subteam^") && strings.HasSuffix(token, ">"):
+			// '<!subteam^S0ONCALL|@oncall>'
+			_, handle, _ := strings.Cut(strings.TrimSuffix(token, ">"), "|")
+			entries = append(entries, handle)
+		default:
+			entries = append(entries, token)
+		}
+	}
+	return channels, entries
+}
+
+// verifySlackSignature checks that a request was signed by Slack with the app's signing secret, and recently.
+func verifySlackSignature(signingSecret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Missing or invalid X-Slack-Request-Timestamp '%s'", timestamp)
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return fmt.Errorf("Request signed %s ago, possibly a replay", age.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("Invalid X-Slack-Signature")
+	}
+	return nil
+}
+
+// postSlashCommandResponse sends text to the user who ran a slash command, through its response_url.
+func postSlashCommandResponse(responseURL, text string) error {
+	body, err := json.Marshal(slashCommandResponse{ResponseType: "ephemeral", Text: text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, responseURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := slackAPI.doExternal(requestCtx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		printErrorResponseBody(resp)
+		return fmt.Errorf("Non-200 status code (%d)", resp.StatusCode)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// configureTransport replaces the default HTTP transport, which every Slack API client uses, with one going
+// through the given proxy (or the one from the environment) and trusting the CAs of caBundle on top of the
+// system's.
+func configureTransport(proxyURL, caBundle, minVersion string) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// all requests go to slack.com, so keep more than the default 2 idle connections around
+	transport.MaxIdleConnsPerHost = 16
+
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil || proxy.Host == "" {
+			return fmt.Errorf("invalid -proxy '%s', expected a URL like 'http://proxy.corp:3128'", proxyURL)
+		}
+		// credentials in the URL are sent as Proxy-Authorization
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{}
+	switch minVersion {
+	case "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("invalid -tls_min_version '%s', expected '1.2' or '1.3'", minVersion)
+	}
+
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return fmt.Errorf("Unable to read CA bundle: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in CA bundle %s", caBundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	http.DefaultTransport = transport
+	return nil
+}
+
+// doExternal sends a request to an API other than Slack's, like a directory a user source comes from, with
+// ctx. It shares the client and -timeout, but not the Slack rate limiting and retries.
+func (c *apiClient) doExternal(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	if traceRequests {
+		traceRequest(req)
+	}
+	resp, err := c.httpClient.Do(req)
+	if traceRequests {
+		traceResponse(resp, err)
+	}
+	return resp, err
+}
+
+// do sends a request to the Slack API with ctx, waiting for the rate limiter first. Rate limiting, transient
+// Slack errors and network timeouts are retried up to maxRetries times with exponential backoff, until ctx
+// is done.
+func (c *apiClient) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	endpoint := path.Base(req.URL.Path)
+	if apiBaseURL != nil {
+		req.URL.Scheme = apiBaseURL.Scheme
+		req.URL.Host = apiBaseURL.Host
+	}
+	req = req.WithContext(ctx)
+	var backoff time.Duration
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		start := time.Now()
+		rateLimiter.wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		waited := time.Since(start) + backoff
+
+		if traceRequests {
+			traceRequest(req)
+		}
+		sent := time.Now()
+		resp, err := c.httpClient.Do(req)
+		if traceRequests {
+			traceResponse(resp, err)
+		}
+		cause, retryAfter, slackErr := retryCause(resp, err)
+		requestStats.record(endpoint, waited, cause == "ratelimited")
+		metrics.observeRequest(endpoint, time.Since(sent), waited, cause == "ratelimited", slackErr)
+		if cause == "" || attempt >= maxRetries {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		backoff = backoffDelay(attempt, retryAfter)
+		logWarn("Slack API call %s failed (%s) -- retrying in %s", endpoint, cause, backoff.Round(time.Millisecond))
+		if !sleepUntilDone(ctx, backoff) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// slackError is a Slack API response that isn't ok, e.g. channel_not_found.
+type slackError struct {
+	doing string
+	code  string
+}
+
+func (e *slackError) Error() string {
+	return fmt.Sprintf("Non-ok response while %s: %s", e.doing, e.code)
+}
+
+// slackErrorCode returns the error of a Slack API response that isn't ok, or "" for any other error.
+func slackErrorCode(err error) string {
+	var slackErr *slackError
+	if errors.As(err, &slackErr) {
+		return slackErr.code
+	}
+	return ""
+}
+
+// slackGet calls a Slack API method with its arguments in the URL and decodes the response into v.
+func slackGet(apiToken, endpoint, doing string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiToken))
+
+	_, err = callSlack(req, doing, v)
+	return err
+}
+
+// slackPost calls a Slack API method with body as JSON, or without arguments when body is nil, and decodes
+// the response into v.
+func slackPost(apiToken, endpoint string, body interface{}, doing string, v interface{}) error {
+	req, err := newSlackPost(apiToken, endpoint, body)
+	if err != nil {
+		return err
+	}
+	_, err = callSlack(req, doing, v)
+	return err
+}
+
+func newSlackPost(apiToken, endpoint string, body interface{}) (*http.Request, error) {
+	if body == nil {
+		req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiToken))
+		return req, nil
+	}
+
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiToken))
+	return req, nil
+}
+
+// callSlack sends a request to the Slack API and decodes the response into v, which has Slack's ok and error
+// fields, closing the body before it returns. A response that isn't ok comes back as a *slackError saying
+// what the call was doing, with v decoded all the same for callers that need the details.
+func callSlack(req *http.Request, doing string, v interface{}) (http.Header, error) {
+	resp, err := slackAPI.do(requestCtx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := printErrorResponseBody(resp)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Non-200 status code (%d)", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var status struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, err
+	}
+	if !status.Ok {
+		logDebug("Slack API call %s failed: %s", path.Base(req.URL.Path), redactSecrets(string(body)))
+		return resp.Header, &slackError{doing: doing, code: status.Error}
+	}
+	return resp.Header, nil
+}
+
+// traceRequest logs the method, URL, headers and body of a request, with the Authorization header and any
+// tokens redacted.
+func traceRequest(req *http.Request) {
+	logDebug("> %s %s", req.Method, redactSecrets(req.URL.String()))
+	names := maps.Keys(req.Header)
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(req.Header[name], ", ")
+		if name == "Authorization" {
+			scheme, _, _ := strings.Cut(value, " ")
+			value = scheme + " [redacted]"
+		}
+		logDebug("> %s: %s", name, value)
+	}
+	if req.GetBody == nil {
+		return
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	contents, err := io.ReadAll(body)
+	if err == nil && len(contents) > 0 {
+		logDebug("> %s", traceBody(contents))
+	}
+}
+
+// traceResponse logs the status and body of a response (or the error of a failed request). The body is
+// restored so callers can still decode it.
+func traceResponse(resp *http.Response, err error) {
+	if err != nil {
+		logDebug("< %s", redactSecrets(err.Error()))
+		return
+	}
+	logDebug("< %s", resp.Status)
+	contents, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(contents))
+	if readErr == nil {
+		logDebug("< %s", traceBody(contents))
+	}
+}
+
+// traceBody returns a body for the trace: redacted and cut off after maxTraceBody bytes.
+func traceBody(contents []byte) string {
+	body := redactSecrets(string(contents))
+	if len(body) > maxTraceBody {
+		return fmt.Sprintf("%s... (%d bytes)", body[:maxTraceBody], len(contents))
+	}
+	return body
+}
+
+// redactSecrets replaces Slack tokens and OAuth secrets in s, keeping the token type (e.g. xoxp) since it
+// helps to tell user from bot tokens when diagnosing missing scopes.
+func redactSecrets(s string) string {
+	return secretPattern.ReplaceAllStringFunc(s, func(secret string) string {
+		if strings.HasPrefix(secret, "xox") || strings.HasPrefix(secret, "xapp") {
+			return secret[:5] + "[redacted]"
+		}
+		if strings.HasPrefix(secret, `"access_token"`) {
+			return `"access_token":"[redacted]"`
+		}
+		key, _, _ := strings.Cut(secret, "=")
+		return key + "=[redacted]"
+	})
+}
+
+// retryCause returns why the request should be retried, or an empty string if it shouldn't, along with
+// the delay Slack asked for and the error Slack answered with (if any). The response body is restored so
+// callers can still decode it.
+func retryCause(resp *http.Response, err error) (string, time.Duration, string) {
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return "timeout", 0, ""
+		}
+		return "", 0, ""
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return "ratelimited", time.Duration(seconds) * time.Second, "ratelimited"
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Sprintf("status %d", resp.StatusCode), 0, ""
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, ""
+	}
+
+	body, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if readErr != nil {
+		return "", 0, ""
+	}
+	var data struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &data) != nil {
+		return "", 0, ""
+	}
+	if slices.Contains(retryableErrors, data.Error) {
+		return data.Error, 0, data.Error
+	}
+	return "", 0, data.Error
+}
+
+// backoffDelay returns the delay before the next attempt: what Slack asked for if it did, otherwise
+// exponential backoff (1s, 2s, 4s, ... capped at 30s) with jitter so parallel retries don't line up.
+func backoffDelay(attempt int, retryAfter time.Duration) time.Duration {
+	jitter := time.Duration(mathrand.Int63n(int64(500 * time.Millisecond)))
+	if retryAfter > 0 {
+		return retryAfter + jitter
+	}
+
+	delay := time.Second << attempt
+	if delay > 30*time.Second || delay <= 0 {
+		delay = 30 * time.Second
+	}
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay/2))) + jitter
+}
+
+// sleep waits for d, returning early once requestCtx is cancelled.
+func sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-requestCtx.Done():
+	}
+}
+
+// newTokenBucket creates a rate limiter for rps requests per second. Bursts are capped at one second's
+// worth of requests (and at least one) so short runs don't stall unnecessarily.
+func newTokenBucket(rps float64) *tokenBucket {
+	capacity := rps
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tokenBucket{
+		rate:     rps,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+	}
+}
+
+// wait blocks until a token is available and consumes it. It is safe for concurrent use and does
+// nothing on a nil bucket.
+func (b *tokenBucket) wait() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		sleep(delay)
+		b.last = time.Now()
+		b.tokens = 0
+		return
+	}
+	b.tokens--
+}
+
+func printErrorResponseBody(resp *http.Response) error {
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	logError("%s", bodyBytes)
+
+	return nil
+}
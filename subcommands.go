@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// subcommandFlags are the flags every subcommand accepts, on top of its own.
+var subcommandFlags = []string{"api_token", "token_file", "config", "profile", "private", "include_archived", "channel_cache", "channel_cache_ttl", "rps", "max_retries", "timeout",
+	"proxy", "ca_bundle", "tls_min_version", "log_level", "log_format", "log_file", "audit_log", "team_id", "all_teams", "mock", "debug"}
+
+// subcommands are the task-oriented alternatives to the -action flags, each with only the flags relevant to it.
+var subcommands = []subcommand{
+	{
+		Name:    "invite",
+		Summary: "Invite users to channels",
+		Implies: map[string]string{"action": actionAdd},
+		Flags: []string{"emails", "emails_file", "chunk_size", "progress_file", "email_domain", "from_message", "from_reactions", "reaction", "from_thread", "from_google_group", "google_credentials", "google_admin", "from_entra_group", "entra_tenant", "entra_client_id", "from_okta_group", "okta_org_url", "from_github_team", "github_graphql_url", "from_ldap", "ldap_url", "ldap_base_dn", "ldap_bind_dn", "ldap_attribute", "all_users", "include_guests", "exclude_emails", "exclude_file", "merge", "channels", "channel_set", "interactive",
+			"mpim", "silent", "pace", "invite_batch_size", "unarchive", "topic", "purpose", "metadata", "welcome_message", "dm_template", "notify_owner", "reason",
+			"invite_missing", "connect_missing", "guest", "guest_expires", "user_cache", "user_cache_ttl", "bulk_lookup",
+			"dry_run", "summary_file", "report", "notify", "smtp_server", "smtp_from", "watch", "metrics_listen", "journal"},
+	},
+	{
+		Name:    "remove",
+		Summary: "Remove users from channels",
+		Implies: map[string]string{"action": actionRemove},
+		Flags: []string{"emails", "emails_file", "chunk_size", "progress_file", "email_domain", "from_message", "from_reactions", "reaction", "from_thread", "from_google_group", "google_credentials", "google_admin", "from_entra_group", "entra_tenant", "entra_client_id", "from_okta_group", "okta_org_url", "from_github_team", "github_graphql_url", "from_ldap", "ldap_url", "ldap_base_dn", "ldap_bind_dn", "ldap_attribute", "exclude_emails", "exclude_file", "merge", "channels", "channel_set", "interactive", "notify_owner", "reason",
+			"user_cache", "user_cache_ttl", "bulk_lookup", "dry_run", "yes", "summary_file", "report", "notify", "smtp_server", "smtp_from", "watch", "metrics_listen", "journal"},
+	},
+	{
+		Name:    "list",
+		Summary: "List channels, the members of -channels, or the channels of the -emails users",
+		Implies: map[string]string{"action": actionList},
+		Flags:   []string{"channels", "emails", "mpim", "sort_by", "include_bots", "user_cache", "user_cache_ttl"},
+	},
+	{
+		Name:     "sync",
+		Summary:  "Make the members of -channels match a user group: invite missing members and remove everyone else",
+		Implies:  map[string]string{"remove_extras": "true"},
+		Required: []string{"from_usergroup", "channels|channel_set"},
+		Flags:    []string{"from_usergroup", "exclude_emails", "exclude_file", "channels", "channel_set", "remove_extras", "silent", "dry_run", "yes", "summary_file", "report", "notify", "smtp_server", "smtp_from", "schedule", "metrics_listen", "journal"},
+	},
+	{
+		Name:    "undo",
+		Summary: "Reverse the most recent run recorded in the -journal: remove who it invited and invite back who it removed",
+		Implies: map[string]string{"action": actionUndo},
+		Flags:   []string{"journal", "undo_window", "yes", "dry_run", "summary_file"},
+	},
+	{
+		Name:    "whoami",
+		Summary: "Show the workspace, the user or bot and the OAuth scopes behind the token",
+		Implies: map[string]string{"action": actionWhoami},
+	},
+	{
+		Name:    "serve",
+		Summary: "Serve an HTTP API to invite, remove and audit users (authenticated with $" + serveTokenEnvVar + "), and the /bulk-invite slash command (verified with $" + signingSecretEnvVar + ")",
+		Implies: map[string]string{"action": actionServe},
+		Flags: []string{"listen", "metrics_listen", "join_channels", "merge", "silent", "pace", "invite_batch_size", "notify_owner", "reason", "dry_run", "parallel", "user_cache", "user_cache_ttl",
+			"bulk_lookup", "report"},
+	},
+	{
+		Name:     "audit",
+		Summary:  "Report which users are missing from which channels, without changing anything",
+		Implies:  map[string]string{"action": actionAudit},
+		Required: []string{"channels|channel_set"},
+		Flags:    []string{"emails", "exclude_emails", "exclude_file", "merge", "channels", "channel_set", "user_cache", "user_cache_ttl", "bulk_lookup", "parallel", "schedule", "metrics_listen"},
+	},
+}
+
+// findSubcommand returns the subcommand named by the first argument, if any.
+func findSubcommand(args []string) (subcommand, bool) {
+	if len(args) == 0 {
+		return subcommand{}, false
+	}
+	for _, cmd := range subcommands {
+		if cmd.Name == args[0] {
+			return cmd, true
+		}
+	}
+	return subcommand{}, false
+}
+
+// parseSubcommand parses the arguments of a subcommand with a flag set holding only its flags. They share
+// their values with the global flags, which are marked as set so profiles don't override them.
+func parseSubcommand(cmd subcommand, args []string) error {
+	// implied values are set first so they show up as the defaults in the help text
+	for name, value := range cmd.Implies {
+		err := flag.Set(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	fs := flag.NewFlagSet(os.Args[0]+" "+cmd.Name, flag.ContinueOnError)
+	for _, name := range append(slices.Clone(subcommandFlags), cmd.Flags...) {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n\n%s.\n\nFlags:\n", os.Args[0], cmd.Name, cmd.Summary)
+		fs.PrintDefaults()
+	}
+	flag.Usage = fs.Usage
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected argument: %s\n", fs.Arg(0))
+		fs.Usage()
+		return fmt.Errorf("Unexpected argument '%s'", fs.Arg(0))
+	}
+
+	var setErr error
+	fs.Visit(func(f *flag.Flag) {
+		if err := flag.Set(f.Name, f.Value.String()); err != nil {
+			setErr = err
+		}
+	})
+	if setErr != nil {
+		return setErr
+	}
+	for _, required := range cmd.Required {
+		// alternatives are separated by '|', any one of them will do
+		names := strings.Split(required, "|")
+		given := false
+		for _, name := range names {
+			given = given || fs.Lookup(name).Value.String() != ""
+		}
+		if !given {
+			missing := "-" + strings.Join(names, " or -")
+			fmt.Fprintf(fs.Output(), "'%s' requires %s\n", cmd.Name, missing)
+			fs.Usage()
+			return fmt.Errorf("Missing %s", missing)
+		}
+	}
+	return nil
+}
+
+// usage prints the subcommands followed by every flag, which can also be used without a subcommand.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range subcommands {
+		fmt.Fprintf(out, "  %-8s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(out, "  %-8s %s\n", "auth", "Store, show or remove the Slack token ('auth login|status|logout')")
+	fmt.Fprintf(out, "  %-8s %s\n", "connect", "List, approve or decline Slack Connect invitations")
+	fmt.Fprintf(out, "  %-8s %s\n", "completion", "Print a bash, zsh or fish completion script")
+	fmt.Fprintf(out, "\nRun '%s <command> -h' for the flags of a command. Without a command, all flags can be combined with -action:\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// runCompletionCommand prints the completion script for a shell, or with 'channels' the channel names from
+// the channel cache, which the scripts call to complete -channels.
+func runCompletionCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "bash" && args[0] != "zsh" && args[0] != "fish" && args[0] != "channels") {
+		fmt.Println("Usage: completion bash|zsh|fish|channels")
+		fmt.Println("\tbash, zsh, fish\tprints the completion script for the shell")
+		fmt.Println("\tchannels\tprints the channel names from -channel_cache (or $" + channelCacheEnvVar + ")")
+		return fmt.Errorf("Invalid completion subcommand")
+	}
+
+	var name string
+	var cachePath string
+	completionFlags := flag.NewFlagSet("completion "+args[0], flag.ExitOnError)
+	completionFlags.StringVar(&name, "name", filepath.Base(os.Args[0]), "Name of the installed command the script completes")
+	completionFlags.StringVar(&cachePath, "channel_cache", os.Getenv(channelCacheEnvVar), "Path of the -channel_cache file to read channel names from")
+	completionFlags.Parse(args[1:])
+
+	if args[0] == "channels" {
+		// completion must never fail loudly, so a missing or broken cache just completes nothing
+		if cachePath == "" {
+			return nil
+		}
+		var cache channelCache
+		contents, err := os.ReadFile(cachePath)
+		if err != nil || json.Unmarshal(contents, &cache) != nil {
+			return nil
+		}
+		names := maps.Keys(cache.Channels)
+		sort.Strings(names)
+		for _, channelName := range names {
+			fmt.Println(channelName)
+		}
+		return nil
+	}
+
+	commands := []string{"auth", "connect", "completion"}
+	commandFlags := map[string][]string{}
+	for _, cmd := range subcommands {
+		commands = append(commands, cmd.Name)
+		commandFlags[cmd.Name] = prefixFlags(append(slices.Clone(subcommandFlags), cmd.Flags...))
+	}
+	allFlags := []string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		allFlags = append(allFlags, f.Name)
+	})
+	commandFlags[""] = prefixFlags(allFlags)
+	fmt.Print(completionScript(args[0], name, commands, commandFlags))
+	return nil
+}
+
+// prefixFlags returns the flag names with their leading dash, as completion offers them.
+func prefixFlags(names []string) []string {
+	flags := make([]string, len(names))
+	for i, name := range names {
+		flags[i] = "-" + name
+	}
+	return flags
+}
+
+// completionScript generates the completion script for shell: subcommands, the flags of each subcommand (or
+// all flags without one) and channel names for -channels and -source_channel, asked from 'completion channels'.
+func completionScript(shell, name string, commands []string, commandFlags map[string][]string) string {
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	subcommandNames := []string{}
+	for _, cmd := range subcommands {
+		subcommandNames = append(subcommandNames, cmd.Name)
+	}
+	var b strings.Builder
+
+	switch shell {
+	case "bash":
+		fmt.Fprintf(&b, "%s() {\n", fn)
+		b.WriteString("\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+		b.WriteString("\t# -channels=a,b is split into '-channels', '=' and 'a,b'\n")
+		b.WriteString("\tif [[ $cur == = ]]; then cur=; elif [[ $prev == = ]]; then prev=${COMP_WORDS[COMP_CWORD-2]}; fi\n")
+		b.WriteString("\tif [[ $prev == -channels || $prev == -source_channel ]]; then\n")
+		b.WriteString("\t\tlocal head=; [[ $cur == *,* ]] && head=${cur%,*},\n")
+		fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -P \"$head\" -W \"$(%s completion channels 2>/dev/null)\" -- \"${cur##*,}\"))\n", name)
+		b.WriteString("\t\treturn\n\tfi\n")
+		b.WriteString("\tif [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then\n")
+		fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(commands, " "))
+		b.WriteString("\t\treturn\n\tfi\n")
+		b.WriteString("\tlocal flags\n\tcase ${COMP_WORDS[1]} in\n")
+		for _, cmd := range subcommandNames {
+			fmt.Fprintf(&b, "\t%s) flags=\"%s\" ;;\n", cmd, strings.Join(commandFlags[cmd], " "))
+		}
+		fmt.Fprintf(&b, "\t*) flags=\"%s\" ;;\n", strings.Join(commandFlags[""], " "))
+		b.WriteString("\tesac\n")
+		b.WriteString("\tCOMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+		b.WriteString("}\n")
+		fmt.Fprintf(&b, "complete -F %s %s\n", fn, name)
+	case "zsh":
+		fmt.Fprintf(&b, "#compdef %s\n\n%s() {\n", name, fn)
+		b.WriteString("\tif compset -P '-(channels|source_channel)='; then\n")
+		b.WriteString("\t\tcompset -P '*,'\n")
+		fmt.Fprintf(&b, "\t\tcompadd -S '' -- ${(f)\"$(%s completion channels 2>/dev/null)\"}\n", name)
+		b.WriteString("\t\treturn\n\tfi\n")
+		b.WriteString("\tif [[ ${words[CURRENT-1]} == -channels || ${words[CURRENT-1]} == -source_channel ]]; then\n")
+		b.WriteString("\t\tcompset -P '*,'\n")
+		fmt.Fprintf(&b, "\t\tcompadd -S '' -- ${(f)\"$(%s completion channels 2>/dev/null)\"}\n", name)
+		b.WriteString("\t\treturn\n\tfi\n")
+		b.WriteString("\tif (( CURRENT == 2 )) && [[ ${words[CURRENT]} != -* ]]; then\n")
+		fmt.Fprintf(&b, "\t\tcompadd -- %s\n", strings.Join(commands, " "))
+		b.WriteString("\t\treturn\n\tfi\n")
+		b.WriteString("\tcase ${words[2]} in\n")
+		for _, cmd := range subcommandNames {
+			fmt.Fprintf(&b, "\t%s) compadd -- %s ;;\n", cmd, strings.Join(commandFlags[cmd], " "))
+		}
+		fmt.Fprintf(&b, "\t*) compadd -- %s ;;\n", strings.Join(commandFlags[""], " "))
+		b.WriteString("\tesac\n}\n\n")
+		fmt.Fprintf(&b, "compdef %s %s\n", fn, name)
+	case "fish":
+		fmt.Fprintf(&b, "function %s_channels\n", fn)
+		b.WriteString("\tset -l head (string match -r -- '^.*,' (commandline -ct))\n")
+		fmt.Fprintf(&b, "\tfor channel in (%s completion channels 2>/dev/null)\n", name)
+		b.WriteString("\t\techo $head$channel\n\tend\nend\n\n")
+		fmt.Fprintf(&b, "complete -c %s -f\n", name)
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -a '%s'\n", name, strings.Join(commands, " "))
+		for _, flagName := range commandFlags[""] {
+			flagName = strings.TrimPrefix(flagName, "-")
+			// fish has no per-subcommand flag sets, so each flag is offered with the subcommands that take it
+			seenIn := []string{}
+			for _, cmd := range subcommandNames {
+				if slices.Contains(commandFlags[cmd], "-"+flagName) {
+					seenIn = append(seenIn, cmd)
+				}
+			}
+			condition := "not __fish_seen_subcommand_from " + strings.Join(subcommandNames, " ")
+			if len(seenIn) > 0 {
+				condition += "; or __fish_seen_subcommand_from " + strings.Join(seenIn, " ")
+			}
+			if flagName == "channels" || flagName == "source_channel" {
+				fmt.Fprintf(&b, "complete -c %s -n '%s' -o %s -x -a '(%s_channels)'\n", name, condition, flagName, fn)
+			} else {
+				fmt.Fprintf(&b, "complete -c %s -n '%s' -o %s\n", name, condition, flagName)
+			}
+		}
+	}
+	return b.String()
+}